@@ -44,6 +44,19 @@ const (
 	SMFIA_UNKNOWN = 'U'
 )
 
+// milter protocol versions
+const (
+	SMFI_PROT_VERSION     = uint32(6) // highest protocol version supported by this library
+	SMFI_PROT_VERSION_MIN = uint32(2) // lowest protocol version accepted from the MTA
+)
+
+// maximum size of a data packet, depending on the negotiated SMFIP_MDS_* option
+const (
+	MaxDataSize64K  = 64*1024 - 1   // MILTER_MDS_64K default size
+	MaxDataSize256K = 256*1024 - 1  // MILTER_MDS_256K with OptMDS256K
+	MaxDataSize1M   = 1024*1024 - 1 // MILTER_MDS_1M with OptMDS1M
+)
+
 const (
 	SMFIS_KEEP    = uint32(20)
 	SMFIS_ABORT   = uint32(21)
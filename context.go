@@ -0,0 +1,184 @@
+package milter
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+)
+
+// contextKey is the type of context values set by the milter session
+type contextKey int
+
+const (
+	sessionIDKey contextKey = iota
+	mailIDKey
+	macrosKey
+)
+
+// SessionIDFromContext returns the session ID of the milter session a handler context belongs to
+func SessionIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(sessionIDKey).(string)
+	return id, ok
+}
+
+// MailIDFromContext returns the mail ID of a handler context, ok is false before MAIL FROM
+func MailIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(mailIDKey).(string)
+	return id, ok
+}
+
+// MacrosFromContext returns the macros known when the handler was called, see Modifier.Macros
+func MacrosFromContext(ctx context.Context) map[string]string {
+	macros, _ := ctx.Value(macrosKey).(map[string]string)
+	return macros
+}
+
+// ContextHandler adapts a ContextSessionHandler to be returned by a MilterFactory,
+// the session calls the context aware methods of h
+func ContextHandler(h ContextSessionHandler) SessionHandler {
+	return &contextAdapter{h}
+}
+
+// contextAdapter wraps a ContextSessionHandler, its SessionHandler methods
+// are only used when called directly and pass a background context
+type contextAdapter struct {
+	h ContextSessionHandler
+}
+
+func (a *contextAdapter) Init(sessionID, mailID string) {
+	a.h.Init(context.Background(), sessionID, mailID)
+}
+
+func (a *contextAdapter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	return a.h.Connect(context.Background(), host, family, port, addr, m)
+}
+
+func (a *contextAdapter) Helo(name string, m *Modifier) (Response, error) {
+	return a.h.Helo(context.Background(), name, m)
+}
+
+func (a *contextAdapter) MailFrom(from string, m *Modifier) (Response, error) {
+	return a.h.MailFrom(context.Background(), from, m)
+}
+
+func (a *contextAdapter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	return a.h.RcptTo(context.Background(), rcptTo, m)
+}
+
+func (a *contextAdapter) Header(name string, value string, m *Modifier) (Response, error) {
+	return a.h.Header(context.Background(), name, value, m)
+}
+
+func (a *contextAdapter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return a.h.Headers(context.Background(), h, m)
+}
+
+func (a *contextAdapter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	return a.h.BodyChunk(context.Background(), chunk, m)
+}
+
+func (a *contextAdapter) Body(m *Modifier) (Response, error) {
+	return a.h.Body(context.Background(), m)
+}
+
+func (a *contextAdapter) Disconnect() {
+	a.h.Disconnect(context.Background())
+}
+
+// sessionAdapter lets the session call a SessionHandler like a ContextSessionHandler
+type sessionAdapter struct {
+	h SessionHandler
+}
+
+func (a sessionAdapter) Init(ctx context.Context, sessionID, mailID string) {
+	a.h.Init(sessionID, mailID)
+}
+
+func (a sessionAdapter) Connect(ctx context.Context, host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	return a.h.Connect(host, family, port, addr, m)
+}
+
+func (a sessionAdapter) Helo(ctx context.Context, name string, m *Modifier) (Response, error) {
+	return a.h.Helo(name, m)
+}
+
+func (a sessionAdapter) MailFrom(ctx context.Context, from string, m *Modifier) (Response, error) {
+	return a.h.MailFrom(from, m)
+}
+
+func (a sessionAdapter) RcptTo(ctx context.Context, rcptTo string, m *Modifier) (Response, error) {
+	return a.h.RcptTo(rcptTo, m)
+}
+
+func (a sessionAdapter) Header(ctx context.Context, name string, value string, m *Modifier) (Response, error) {
+	return a.h.Header(name, value, m)
+}
+
+func (a sessionAdapter) Headers(ctx context.Context, h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return a.h.Headers(h, m)
+}
+
+func (a sessionAdapter) BodyChunk(ctx context.Context, chunk []byte, m *Modifier) (Response, error) {
+	return a.h.BodyChunk(chunk, m)
+}
+
+func (a sessionAdapter) Body(ctx context.Context, m *Modifier) (Response, error) {
+	return a.h.Body(m)
+}
+
+func (a sessionAdapter) Disconnect(ctx context.Context) {
+	a.h.Disconnect()
+}
+
+// resolveHandler returns the handler the session calls and the value
+// implementing the optional handler interfaces like DataHandler
+func resolveHandler(h SessionHandler) (ContextSessionHandler, interface{}) {
+	if a, ok := h.(*contextAdapter); ok {
+		return a.h, a.h
+	}
+	return sessionAdapter{h}, h
+}
+
+// startConnection creates the context of a new SMTP connection
+func (m *milterSession) startConnection() {
+	m.endConnection()
+	base := m.baseCtx
+	if base == nil {
+		base = context.Background()
+	}
+	m.connCtx, m.connCancel = context.WithCancel(context.WithValue(base, sessionIDKey, m.sessionID))
+}
+
+// endConnection cancels the context of the SMTP connection and its message
+func (m *milterSession) endConnection() {
+	m.endMessage()
+	if m.connCancel != nil {
+		m.connCancel()
+		m.connCtx, m.connCancel = nil, nil
+	}
+}
+
+// startMessage creates the context of a new message, replacing the one of the previous message
+func (m *milterSession) startMessage() {
+	m.endMessage()
+	m.msgCtx, m.msgCancel = context.WithCancel(context.WithValue(m.context(), mailIDKey, m.mailID))
+}
+
+// endMessage cancels the context of the current message
+func (m *milterSession) endMessage() {
+	if m.msgCancel != nil {
+		m.msgCancel()
+		m.msgCtx, m.msgCancel = nil, nil
+	}
+}
+
+// context returns the context of the current message or SMTP connection
+func (m *milterSession) context() context.Context {
+	if m.msgCtx != nil {
+		return m.msgCtx
+	}
+	if m.connCtx == nil {
+		m.startConnection()
+	}
+	return m.connCtx
+}
@@ -0,0 +1,82 @@
+package milter
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+// ctxHandler records the contexts its callbacks receive
+type ctxHandler struct {
+	init, mail, body context.Context
+}
+
+func (h *ctxHandler) Init(ctx context.Context, sessionID, mailID string) { h.init = ctx }
+func (h *ctxHandler) Disconnect(ctx context.Context)                     {}
+func (h *ctxHandler) Connect(ctx context.Context, host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+func (h *ctxHandler) Helo(ctx context.Context, name string, m *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+func (h *ctxHandler) MailFrom(ctx context.Context, from string, m *Modifier) (Response, error) {
+	h.mail = ctx
+	return RespContinue, nil
+}
+func (h *ctxHandler) RcptTo(ctx context.Context, rcptTo string, m *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+func (h *ctxHandler) Header(ctx context.Context, name string, value string, m *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+func (h *ctxHandler) Headers(ctx context.Context, hdr textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+func (h *ctxHandler) BodyChunk(ctx context.Context, chunk []byte, m *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+func (h *ctxHandler) Body(ctx context.Context, m *Modifier) (Response, error) {
+	h.body = ctx
+	return RespAccept, nil
+}
+
+func TestContextHandler(t *testing.T) {
+	base, cancel := context.WithCancel(context.Background())
+	h := &ctxHandler{}
+	m := &milterSession{milter: ContextHandler(h), baseCtx: base}
+	mta := startSession(t, m)
+	mta.send(SMFIC_MACRO, macroPacket(SMFIC_MAIL, "{mail_addr}", "from@example.com"))
+	mta.send(SMFIC_MAIL, []byte("<from@example.com>"+null))
+	mta.expect(SMFIR_CONTINUE)
+
+	if id, ok := SessionIDFromContext(h.mail); !ok || id == "" {
+		t.Errorf("session ID missing in context")
+	}
+	if id, ok := MailIDFromContext(h.mail); !ok || id == "" {
+		t.Errorf("mail ID missing in context")
+	}
+	if MacrosFromContext(h.mail)["{mail_addr}"] != "from@example.com" {
+		t.Errorf("macros missing in context: %v", MacrosFromContext(h.mail))
+	}
+
+	// abort cancels the message context but not the connection
+	mta.send(SMFIC_ABORT, nil)
+	mta.send(SMFIC_BODYEOB, nil)
+	mta.expect(SMFIR_ACCEPT)
+	if h.mail.Err() == nil {
+		t.Errorf("message context not cancelled on abort")
+	}
+	if h.body.Err() != nil {
+		t.Errorf("connection context cancelled on abort")
+	}
+	if _, ok := MailIDFromContext(h.body); ok {
+		t.Errorf("mail ID still set after abort")
+	}
+
+	// closing the server cancels all sessions
+	cancel()
+	if h.body.Err() == nil {
+		t.Errorf("connection context not cancelled with server context")
+	}
+}
@@ -0,0 +1,116 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// DefaultMaxPacketSize is the largest packet accepted from the MTA if WithMaxPacketSize is not used,
+// it leaves room for body chunks negotiated with OptMDS1M
+const DefaultMaxPacketSize = 2 * 1024 * 1024
+
+var ipv6prefix = []byte("IPv6:")
+
+// families maps SMFIA_* protocol families to network names
+var families = map[byte]string{
+	SMFIA_UNKNOWN: "unknown",
+	SMFIA_UNIX:    "unix",
+	SMFIA_INET:    "tcp4",
+	SMFIA_INET6:   "tcp6",
+}
+
+// connectInfo is the decoded data of SMFIC_CONNECT
+type connectInfo struct {
+	host   string
+	family string
+	port   uint16
+	addr   net.IP
+}
+
+// malformed returns an ErrMalformedPacket error for command code
+func malformed(code byte, format string, v ...interface{}) error {
+	return fmt.Errorf("%w: %c: %s", ErrMalformedPacket, code, fmt.Sprintf(format, v...))
+}
+
+// cString splits a NUL terminated string from data
+func cString(data []byte) (string, []byte, bool) {
+	pos := bytes.IndexByte(data, 0)
+	if pos == -1 {
+		return "", data, false
+	}
+	return string(data[:pos]), data[pos+1:], true
+}
+
+// decodeConnect decodes hostname, protocol family, port and address of SMFIC_CONNECT
+func decodeConnect(data []byte) (connectInfo, error) {
+	var info connectInfo
+	host, data, ok := cString(data)
+	if !ok {
+		return info, malformed(SMFIC_CONNECT, "hostname not terminated")
+	}
+	info.host = host
+	// get protocol family
+	if len(data) < 1 {
+		return info, malformed(SMFIC_CONNECT, "missing protocol family")
+	}
+	protocolFamily := data[0]
+	data = data[1:]
+	info.family = families[protocolFamily]
+	if protocolFamily == SMFIA_UNKNOWN {
+		return info, nil
+	}
+	// get port
+	if protocolFamily == SMFIA_INET || protocolFamily == SMFIA_INET6 {
+		if len(data) < 2 {
+			return info, malformed(SMFIC_CONNECT, "missing port")
+		}
+		info.port = binary.BigEndian.Uint16(data)
+		data = data[2:]
+		// trim IPv6 prefix when necessary
+		data = bytes.TrimPrefix(data, ipv6prefix)
+	}
+	// get address
+	info.addr = net.ParseIP(readCString(data))
+	return info, nil
+}
+
+// decodeMacro decodes the command code and the name value pairs of SMFIC_MACRO
+func decodeMacro(data []byte) (byte, map[string]string, error) {
+	if len(data) == 0 {
+		return 0, nil, ErrMacroNoData
+	}
+	macros := make(map[string]string)
+	// convert data to Go strings
+	strs := decodeCStrings(data[1:])
+	// store data in a map
+	for i := 0; i+1 < len(strs); i += 2 {
+		macros[strs[i]] = strs[i+1]
+	}
+	return data[0], macros, nil
+}
+
+// decodeHeader decodes name and value of SMFIC_HEADER, the value may be empty
+func decodeHeader(data []byte) (string, string, error) {
+	headerData := decodeCStrings(data)
+	if len(headerData) == 0 || headerData[0] == "" {
+		return "", "", malformed(SMFIC_HEADER, "missing header name")
+	}
+	name, value := headerData[0], ""
+	if len(headerData) >= 2 {
+		value = headerData[1]
+	}
+	return name, value, nil
+}
+
+// decodeOptNeg decodes version, actions and protocol options offered with SMFIC_OPTNEG
+func decodeOptNeg(data []byte) (uint32, OptAction, OptProtocol, error) {
+	if len(data) < 12 {
+		return 0, 0, 0, malformed(SMFIC_OPTNEG, "expected 12 bytes, got %d", len(data))
+	}
+	version := binary.BigEndian.Uint32(data[0:4])
+	actions := OptAction(binary.BigEndian.Uint32(data[4:8]))
+	protocol := OptProtocol(binary.BigEndian.Uint32(data[8:12]))
+	return version, actions, protocol, nil
+}
@@ -0,0 +1,151 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// commands are all command codes the MTA may send
+var commands = []byte{
+	SMFIC_ABORT, SMFIC_BODY, SMFIC_CONNECT, SMFIC_MACRO, SMFIC_BODYEOB, SMFIC_HELO, SMFIC_QUIT_NC,
+	SMFIC_HEADER, SMFIC_MAIL, SMFIC_EOH, SMFIC_OPTNEG, SMFIC_QUIT, SMFIC_RCPT, SMFIC_DATA, SMFIC_UNKNOWN,
+}
+
+// packet encodes a milter packet with length prefix
+func packet(code byte, data []byte) []byte {
+	buf := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)+1))
+	buf[4] = code
+	return append(buf, data...)
+}
+
+func TestReadPacketLimits(t *testing.T) {
+	m := &milterSession{sock: &bufferSock{*bytes.NewBuffer([]byte{0, 0, 0, 0})}}
+	if _, err := m.ReadPacket(); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("expected ErrMalformedPacket for empty packet, got %v", err)
+	}
+	m = &milterSession{sock: &bufferSock{*bytes.NewBuffer(packet(SMFIC_BODY, make([]byte, 100)))}, maxPacketSize: 64}
+	if _, err := m.ReadPacket(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("expected ErrPacketTooLarge, got %v", err)
+	}
+	m = &milterSession{sock: &bufferSock{*bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, SMFIC_BODY})}}
+	if _, err := m.ReadPacket(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("expected ErrPacketTooLarge with default limit, got %v", err)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("host"),
+		[]byte("host\x00"),
+		[]byte("host\x004\x00"),
+	} {
+		if _, err := decodeConnect(data); !errors.Is(err, ErrMalformedPacket) {
+			t.Errorf("decodeConnect(%q): expected ErrMalformedPacket, got %v", data, err)
+		}
+	}
+	if _, _, err := decodeMacro(nil); !errors.Is(err, ErrMalformedPacket) || !errors.Is(err, ErrMacroNoData) {
+		t.Errorf("decodeMacro: expected ErrMacroNoData, got %v", err)
+	}
+	if _, _, err := decodeHeader(nil); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("decodeHeader: expected ErrMalformedPacket, got %v", err)
+	}
+	if _, _, _, err := decodeOptNeg([]byte{0, 0, 0, 6}); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("decodeOptNeg: expected ErrMalformedPacket, got %v", err)
+	}
+
+	info, err := decodeConnect([]byte("mx.example.com\x006\x00\x19IPv6:2001:db8::1\x00"))
+	if err != nil || info.host != "mx.example.com" || info.family != "tcp6" || info.port != 25 || info.addr.String() != "2001:db8::1" {
+		t.Errorf("decodeConnect: unexpected %+v %v", info, err)
+	}
+}
+
+func FuzzReadPacket(f *testing.F) {
+	for _, code := range commands {
+		f.Add(packet(code, []byte("data\x00")))
+	}
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		m := &milterSession{sock: &bufferSock{*bytes.NewBuffer(stream)}, maxPacketSize: 4096}
+		for {
+			msg, err := m.ReadPacket()
+			if err != nil {
+				return
+			}
+			if len(msg.Data)+1 > 4096 {
+				t.Fatalf("packet of %d bytes exceeds limit", len(msg.Data)+1)
+			}
+		}
+	})
+}
+
+// FuzzProcess feeds arbitrary payloads for every command code to a session
+func FuzzProcess(f *testing.F) {
+	seeds := map[byte][][]byte{
+		SMFIC_CONNECT: {[]byte("mx.example.com\x004\x00\x19192.0.2.1\x00"), []byte("localhost\x00L\x00\x00/tmp/sock\x00"), []byte("unknown\x00U")},
+		SMFIC_MACRO:   {macroPacket(SMFIC_CONNECT, "{client_addr}", "192.0.2.1"), macroPacket(SMFIC_RCPT, "{rcpt_mailer}", "error")},
+		SMFIC_OPTNEG:  {optneg(6, OptAllActions, 0x1fffff)},
+		SMFIC_HEADER:  {[]byte("Subject\x00test\x00"), []byte("Empty\x00")},
+		SMFIC_MAIL:    {[]byte("<from@example.com>\x00SIZE=100\x00")},
+		SMFIC_RCPT:    {[]byte("<to@example.com>\x00NOTIFY=NEVER\x00")},
+		SMFIC_HELO:    {[]byte("mx.example.com\x00")},
+		SMFIC_BODY:    {[]byte("body chunk")},
+		SMFIC_UNKNOWN: {[]byte("XFOO\x00")},
+	}
+	for _, code := range commands {
+		f.Add(code, []byte{})
+		for _, data := range seeds[code] {
+			f.Add(code, data)
+		}
+	}
+	f.Fuzz(func(t *testing.T, code byte, data []byte) {
+		m := &milterSession{
+			protocol: OptRcptRej | OptSkip,
+			milter:   &DefaultSession{},
+			sock:     new(bufferSock),
+			logger:   NopLogger,
+		}
+		m.milter.Init("session", "mail")
+		m.Process(&Message{code, data})
+	})
+}
+
+func FuzzDecodeConnect(f *testing.F) {
+	f.Add([]byte("mx.example.com\x004\x00\x19192.0.2.1\x00"))
+	f.Add([]byte("mx.example.com\x006\x00\x19IPv6:2001:db8::1\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeConnect(data)
+	})
+}
+
+func FuzzDecodeMacro(f *testing.F) {
+	f.Add(macroPacket(SMFIC_MAIL, "i", "4711", "{mail_addr}"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeMacro(data)
+	})
+}
+
+func FuzzDecodeHeader(f *testing.F) {
+	f.Add([]byte("Subject\x00test\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeHeader(data)
+	})
+}
+
+func FuzzDecodeOptNeg(f *testing.F) {
+	f.Add(optneg(6, OptAllActions, 0x1fffff))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeOptNeg(data)
+	})
+}
+
+func FuzzParseEnvelope(f *testing.F) {
+	f.Add([]byte("<from@example.com>\x00SIZE=100\x00BODY=8BITMIME\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parseEnvelope(data)
+	})
+}
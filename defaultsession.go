@@ -18,6 +18,7 @@ type DefaultSession struct {
 	HeloName       string
 	ClientIP       net.IP
 	Rcpts          []string
+	RejectedRcpts  []RejectedRecipient
 	MessageHeaders textproto.MIMEHeader
 	Message        *bytes.Buffer
 }
@@ -54,6 +55,12 @@ func (e *DefaultSession) RcptTo(rcptTo string, m *Modifier) (Response, error) {
 	return RespContinue, nil
 }
 
+// RejectedRcpt is called for recipients the MTA already rejected, if OptRcptRej was negotiated
+func (e *DefaultSession) RejectedRcpt(rcpt RejectedRecipient, m *Modifier) (Response, error) {
+	e.RejectedRcpts = append(e.RejectedRcpts, rcpt)
+	return RespContinue, nil
+}
+
 /* handle headers one by one */
 func (e *DefaultSession) Header(name, value string, m *Modifier) (Response, error) {
 	headerLine := fmt.Sprintf("%s: %s\r\n", name, value)
@@ -2,11 +2,37 @@ package milter
 
 import (
 	"errors"
+	"fmt"
 )
 
 // pre-defined errors
 var (
 	ErrCloseSession = errors.New("Stop current milter processing")
-	ErrMacroNoData  = errors.New("Macro definition with no data")
+	ErrMacroNoData  = fmt.Errorf("%w: Macro definition with no data", ErrMalformedPacket)
 	ErrNoListenAddr = errors.New("no listen addr specified")
+
+	// Unix socket errors, returned when an existing file is in the way of the socket
+	ErrSocketInUse = errors.New("unix socket is in use by another process")
+	ErrNotSocket   = errors.New("file exists and is not a unix socket")
+
+	// decoding errors, returned for packets the MTA must never send
+	ErrPacketTooLarge  = errors.New("milter packet too large")
+	ErrMalformedPacket = errors.New("malformed milter packet")
+
+	// option negotiation errors, returned when the MTA cannot provide what the MilterFactory requested
+	ErrUnsupportedVersion  = errors.New("MTA protocol version not supported")
+	ErrUnsupportedActions  = errors.New("MTA does not offer requested actions")
+	ErrUnsupportedProtocol = errors.New("MTA does not offer requested protocol options")
+
+	// modification errors, returned by Modifier before anything is sent to the MTA
+	ErrActionNotNegotiated = errors.New("action was not negotiated with MTA")
+	ErrWrongStage          = errors.New("action is only allowed at end of message")
+
+	// ErrTimeout is reported when the MTA connection exceeds one of the configured timeouts
+	ErrTimeout = errors.New("milter connection timeout")
+	// ErrHandlerTimeout is reported when a handler exceeds the timeout set with WithHandlerTimeout
+	ErrHandlerTimeout = errors.New("milter handler timeout")
+
+	// ErrInvalidReply is returned by Reply for replies the MTA would not accept
+	ErrInvalidReply = errors.New("invalid SMTP reply")
 )
@@ -0,0 +1,92 @@
+package milter
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ESMTPArgs holds the ESMTP parameters of MAIL FROM or RCPT TO, e.g. SIZE, BODY or NOTIFY.
+// Keywords are upper case, keywords without value (like SMTPUTF8) map to an empty string.
+type ESMTPArgs map[string]string
+
+// Get returns the value of a parameter, the keyword is case insensitive
+func (a ESMTPArgs) Get(keyword string) (string, bool) {
+	value, ok := a[strings.ToUpper(keyword)]
+	return value, ok
+}
+
+// Size returns the message size announced with the SIZE parameter
+func (a ESMTPArgs) Size() (int64, bool) {
+	value, ok := a.Get("SIZE")
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// RejectedRecipient is a recipient the MTA already rejected, only sent when OptRcptRej was negotiated
+type RejectedRecipient struct {
+	Addr   string
+	Args   ESMTPArgs
+	Code   int    // SMTP reply code, 0 if the MTA did not report it
+	Status string // enhanced status code, e.g. "5.1.1"
+	Text   string // reply text of the MTA
+}
+
+// rejectedRecipient returns the rejection details if the RCPT macros mark the recipient
+// as rejected: {rcpt_mailer} is "error", {rcpt_host} holds the status and {rcpt_addr} the text
+func rejectedRecipient(addr string, args ESMTPArgs, macros map[string]string) (RejectedRecipient, bool) {
+	if macros[string(MACRO_RCPT_MAILER)] != "error" {
+		return RejectedRecipient{}, false
+	}
+	rcpt := RejectedRecipient{Addr: addr, Args: args, Text: macros[string(MACRO_RCPT_ADDR)]}
+	status := macros[string(MACRO_RCPT_HOST)]
+	if code, ok := replyCode(status); ok {
+		rcpt.Code = code
+	} else {
+		rcpt.Status = status
+	}
+	if rcpt.Code == 0 {
+		rcpt.Code, _ = replyCode(strings.SplitN(rcpt.Text, " ", 2)[0])
+	}
+	return rcpt, true
+}
+
+// replyCode parses a three digit SMTP reply code
+func replyCode(s string) (int, bool) {
+	if len(s) != 3 {
+		return 0, false
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 200 || code > 599 {
+		return 0, false
+	}
+	return code, true
+}
+
+// parseEnvelope splits the data of SMFIC_MAIL and SMFIC_RCPT into the address and its ESMTP parameters
+func parseEnvelope(data []byte) (string, ESMTPArgs) {
+	// not decodeCStrings, an empty address must not shift the parameters
+	strs := strings.Split(strings.TrimRight(string(data), null), null)
+	args := make(ESMTPArgs, len(strs)-1)
+	for _, arg := range strs[1:] {
+		if arg == "" {
+			continue
+		}
+		keyword, value, _ := strings.Cut(arg, "=")
+		args[strings.ToUpper(keyword)] = value
+	}
+	return trimAddress(strs[0]), args
+}
+
+// trimAddress removes the angle brackets around an envelope address
+func trimAddress(addr string) string {
+	if strings.HasPrefix(addr, "<") && strings.HasSuffix(addr, ">") {
+		return addr[1 : len(addr)-1]
+	}
+	return addr
+}
@@ -0,0 +1,118 @@
+package milter
+
+import "testing"
+
+func TestParseEnvelope(t *testing.T) {
+	tests := []struct {
+		data string
+		addr string
+		args ESMTPArgs
+	}{
+		{"<from@example.com>\x00", "from@example.com", ESMTPArgs{}},
+		{"<>\x00", "", ESMTPArgs{}},
+		{"<from@example.com>\x00SIZE=1024\x00body=8BITMIME\x00SMTPUTF8\x00", "from@example.com",
+			ESMTPArgs{"SIZE": "1024", "BODY": "8BITMIME", "SMTPUTF8": ""}},
+		{"<to@example.com>\x00NOTIFY=SUCCESS,FAILURE\x00ORCPT=rfc822;to@example.com\x00", "to@example.com",
+			ESMTPArgs{"NOTIFY": "SUCCESS,FAILURE", "ORCPT": "rfc822;to@example.com"}},
+		{"\x00SIZE=1\x00", "", ESMTPArgs{"SIZE": "1"}},
+	}
+	for _, tt := range tests {
+		addr, args := parseEnvelope([]byte(tt.data))
+		if addr != tt.addr {
+			t.Errorf("%q: expected address %q, got %q", tt.data, tt.addr, addr)
+		}
+		if len(args) != len(tt.args) {
+			t.Errorf("%q: expected args %v, got %v", tt.data, tt.args, args)
+		}
+		for k, v := range tt.args {
+			if got, ok := args.Get(k); !ok || got != v {
+				t.Errorf("%q: expected %s=%q, got %q", tt.data, k, v, got)
+			}
+		}
+	}
+
+	_, args := parseEnvelope([]byte("<from@example.com>\x00SIZE=1024\x00"))
+	if size, ok := args.Size(); !ok || size != 1024 {
+		t.Errorf("expected SIZE 1024, got %d %v", size, ok)
+	}
+}
+
+func TestRejectedRecipient(t *testing.T) {
+	h := &DefaultSession{}
+	m := &milterSession{protocol: OptRcptRej, milter: h, logger: NopLogger}
+	process := func(code byte, data string) {
+		t.Helper()
+		if _, err := m.Process(&Message{code, []byte(data)}); err != nil {
+			t.Fatalf("process %c: %v", code, err)
+		}
+	}
+
+	process(SMFIC_MACRO, string(macroPacket(SMFIC_RCPT, "{rcpt_mailer}", "error", "{rcpt_host}", "5.1.1",
+		"{rcpt_addr}", "550 5.1.1 <unknown@example.com>: Recipient address rejected: User unknown")))
+	process(SMFIC_RCPT, "<unknown@example.com>\x00")
+	process(SMFIC_MACRO, string(macroPacket(SMFIC_RCPT, "{rcpt_mailer}", "local", "{rcpt_addr}", "to@example.com")))
+	process(SMFIC_RCPT, "<to@example.com>\x00")
+
+	if len(h.Rcpts) != 1 || h.Rcpts[0] != "to@example.com" {
+		t.Errorf("expected only accepted recipient in Rcpts, got %v", h.Rcpts)
+	}
+	if len(h.RejectedRcpts) != 1 {
+		t.Fatalf("expected one rejected recipient, got %v", h.RejectedRcpts)
+	}
+	if r := h.RejectedRcpts[0]; r.Addr != "unknown@example.com" || r.Code != 550 || r.Status != "5.1.1" {
+		t.Errorf("unexpected rejected recipient %+v", r)
+	}
+}
+
+// rcptHandler records the recipients passed to RcptTo
+type rcptHandler struct {
+	testHandler
+	rcpts []string
+}
+
+func (h *rcptHandler) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	h.rcpts = append(h.rcpts, rcptTo)
+	return RespContinue, nil
+}
+
+func TestRejectedRecipientDispatch(t *testing.T) {
+	rejected := macroPacket(SMFIC_RCPT, "{rcpt_mailer}", "error", "{rcpt_host}", "5.1.1", "{rcpt_addr}", "550 5.1.1 User unknown")
+	run := func(h SessionHandler, offer OptProtocol) Response {
+		t.Helper()
+		m := &milterSession{protocol: OptRcptRej, fallback: true, milter: h, logger: NopLogger}
+		for _, msg := range []*Message{
+			{SMFIC_OPTNEG, optneg(6, OptAllActions, offer)},
+			{SMFIC_MAIL, []byte("<from@example.com>" + null)},
+			{SMFIC_MACRO, rejected},
+		} {
+			if _, err := m.Process(msg); err != nil {
+				t.Fatalf("process %c: %v", msg.Code, err)
+			}
+		}
+		resp, err := m.Process(&Message{SMFIC_RCPT, []byte("<unknown@example.com>" + null)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// negotiated rejected recipients reach RejectedRcpt and stay out of Rcpts
+	session := &DefaultSession{}
+	run(session, 0x1fffff)
+	if len(session.Rcpts) != 0 || len(session.RejectedRcpts) != 1 || session.RejectedRcpts[0].Addr != "unknown@example.com" {
+		t.Errorf("unexpected recipients %v, rejected %v", session.Rcpts, session.RejectedRcpts)
+	}
+
+	// handlers without RejectedRcpt never see them
+	h := &rcptHandler{testHandler: testHandler{resp: RespContinue}}
+	if resp := run(h, 0x1fffff); resp != RespContinue || len(h.rcpts) != 0 {
+		t.Errorf("expected rejected recipient to be skipped, got %v %v", resp, h.rcpts)
+	}
+
+	// without OptRcptRej every recipient is accepted by the MTA and passed to RcptTo
+	h = &rcptHandler{testHandler: testHandler{resp: RespContinue}}
+	run(h, 0x1fffff&^OptRcptRej)
+	if len(h.rcpts) != 1 {
+		t.Errorf("expected recipient in RcptTo, got %v", h.rcpts)
+	}
+}
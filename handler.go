@@ -0,0 +1,217 @@
+package milter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// PanicError is passed to the handlers set with WithPanicHandler when a milter handler panics
+type PanicError struct {
+	Value     interface{} // value passed to panic
+	Stack     []byte      // stack trace of the panicking goroutine
+	SessionID string
+	MailID    string
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("milter handler panic: %v", e.Value)
+}
+
+// Unwrap returns the panic value if it is an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// recoverPanic turns a panic of the calling goroutine into a *PanicError stored in err
+func recoverPanic(err *error, sessionID, mailID string) {
+	if r := recover(); r != nil {
+		*err = &PanicError{Value: r, Stack: debug.Stack(), SessionID: sessionID, MailID: mailID}
+	}
+}
+
+// handlerCall runs a handler callback of a command with the given context
+type handlerCall func(ctx context.Context) (Response, error)
+
+// run calls the handler callback, a panic is returned as *PanicError
+func (call handlerCall) run(ctx context.Context, sessionID, mailID string) (resp Response, err error) {
+	defer recoverPanic(&err, sessionID, mailID)
+	return call(ctx)
+}
+
+// handlerTimeout is the run time limit of handlers and the response sent when it passes
+type handlerTimeout struct {
+	timeout time.Duration
+	resp    Response
+}
+
+// invoke runs the handler callback of command code, handler errors are turned
+// into responses by VerdictError and the error policy
+func (m *milterSession) invoke(code byte, mod *Modifier, call handlerCall) (Response, error) {
+	resp, err := m.runCall(code, mod, call)
+	if err == nil || err == ErrCloseSession {
+		return resp, err
+	}
+	// panics and hung handlers are not errors of the handler
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) || errors.Is(err, ErrHandlerTimeout) {
+		return resp, err
+	}
+	if verdict := m.verdict(err); verdict != nil {
+		m.logger.Printf("Error performing milter command %c, answering %c: %v", code, verdict.Response().Code, err)
+		return verdict, nil
+	}
+	return resp, err
+}
+
+// handlerTimeout returns the handler timeout configured for command code
+func (m *milterSession) handlerTimeout(code byte) (handlerTimeout, bool) {
+	limit, ok := m.handlerTimeouts[code]
+	if !ok {
+		limit, ok = m.handlerTimeouts[0]
+	}
+	return limit, ok && limit.timeout > 0
+}
+
+// runCall runs the handler callback of command code. With a handler timeout configured for
+// the command, the callback runs in its own goroutine and is abandoned when it passes:
+// its context is cancelled, its Modifier can not send packets anymore and the next
+// handler call waits until it returned, see waitHandler.
+func (m *milterSession) runCall(code byte, mod *Modifier, call handlerCall) (Response, error) {
+	if err := m.waitHandler(); err != nil {
+		return nil, err
+	}
+	limit, ok := m.handlerTimeout(code)
+	if !ok {
+		return call.run(mod.ctx, m.sessionID, m.mailID)
+	}
+
+	ctx, cancel := context.WithTimeout(mod.ctx, limit.timeout)
+	defer cancel()
+	mod.ctx = ctx
+
+	type result struct {
+		resp Response
+		err  error
+	}
+	done := make(chan result, 1)
+	finished := make(chan struct{})
+	// abandoned is set before decided is closed, the goroutine reports
+	// its own panic if nobody waits for its result anymore
+	abandoned := false
+	decided := make(chan struct{})
+	defer close(decided)
+	sessionID, mailID := m.sessionID, m.mailID
+	go func() {
+		defer close(finished)
+		resp, err := call.run(ctx, sessionID, mailID)
+		done <- result{resp, err}
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			<-decided
+			if abandoned {
+				m.reportPanic(fmt.Sprintf("abandoned milter command %c", code), panicErr)
+			}
+		}
+	}()
+
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-ctx.Done():
+		abandoned = true
+		m.pending, m.pendingWait = finished, limit.timeout
+		err := fmt.Errorf("%w: command %c: %v", ErrHandlerTimeout, code, ctx.Err())
+		m.logger.Printf("Error performing milter command: %v", err)
+		m.reportError(err)
+		return limit.resp, nil
+	}
+}
+
+// waitHandler waits for a handler call abandoned after its timeout to return, so handlers
+// are never called concurrently. It waits at most the timeout of the abandoned call, if the
+// handler is still running then it never returns again in time: the error ends the session.
+func (m *milterSession) waitHandler() error {
+	if m.pending == nil {
+		return nil
+	}
+	timer := time.NewTimer(m.pendingWait)
+	defer timer.Stop()
+	select {
+	case <-m.pending:
+		m.pending = nil
+		return nil
+	case <-timer.C:
+		// later calls do not wait again
+		m.pendingWait = 0
+		return fmt.Errorf("%w: abandoned handler did not return", ErrHandlerTimeout)
+	}
+}
+
+// callInit calls Init of the handler, a panic is returned as *PanicError
+func (m *milterSession) callInit() error {
+	if err := m.waitHandler(); err != nil {
+		return err
+	}
+	return m.recoverCall(func() { m.handler.Init(m.context(), m.sessionID, m.mailID) })
+}
+
+// callDisconnect calls Disconnect of the handler, a panic is returned as *PanicError
+func (m *milterSession) callDisconnect() error {
+	if err := m.waitHandler(); err != nil {
+		return err
+	}
+	return m.recoverCall(func() { m.handler.Disconnect(m.context()) })
+}
+
+// recoverCall runs f, a panic is returned as *PanicError
+func (m *milterSession) recoverCall(f func()) (err error) {
+	defer recoverPanic(&err, m.sessionID, m.mailID)
+	f()
+	return nil
+}
+
+// process runs Process, a panic is returned as *PanicError
+func (m *milterSession) process(msg *Message) (resp Response, err error) {
+	defer recoverPanic(&err, m.sessionID, m.mailID)
+	return m.Process(msg)
+}
+
+// recovered passes a panic of command code to the panic handlers and returns the response
+// sent instead. If the MTA expects no reply to the command the session is closed.
+func (m *milterSession) recovered(code byte, p *PanicError) (Response, error) {
+	m.reportPanic(fmt.Sprintf("milter command %c", code), p)
+	switch code {
+	case SMFIC_ABORT, SMFIC_MACRO, SMFIC_OPTNEG, SMFIC_QUIT, SMFIC_QUIT_NC:
+		return nil, ErrCloseSession
+	}
+	if m.protocol&noReply[code] != 0 {
+		return nil, ErrCloseSession
+	}
+	if m.panicResponse == nil {
+		return RespTempFail, nil
+	}
+	return m.panicResponse, nil
+}
+
+// reportPanic logs a recovered panic and passes it to the panic handlers
+func (m *milterSession) reportPanic(where string, p *PanicError) {
+	m.logger.Printf("Recovered panic in %s: %v\n%s", where, p.Value, p.Stack)
+	for _, handler := range m.panicHandlers {
+		handler(p)
+	}
+}
+
+// sessionError reports an error of Init or Disconnect, which have no response
+func (m *milterSession) sessionError(where string, err error) {
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		m.reportPanic(where, panicErr)
+		return
+	}
+	m.logger.Printf("Error in %s: %v", where, err)
+	m.reportError(err)
+}
@@ -1,6 +1,7 @@
 package milter
 
 import (
+	"context"
 	"net"
 	"net/textproto"
 )
@@ -47,3 +48,55 @@ type SessionHandler interface {
 	// Disconnect is called at the end of the message Handling loop
 	Disconnect()
 }
+
+// ContextSessionHandler is a SessionHandler whose callbacks receive a context. The context
+// is cancelled when the MTA aborts the message, the connection ends or the server is
+// closed, and carries the session ID, mail ID and macros (see SessionIDFromContext,
+// MailIDFromContext and MacrosFromContext). Return it from a MilterFactory with ContextHandler.
+type ContextSessionHandler interface {
+	Init(ctx context.Context, sessionID, mailID string)
+	Connect(ctx context.Context, host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error)
+	Helo(ctx context.Context, name string, m *Modifier) (Response, error)
+	MailFrom(ctx context.Context, from string, m *Modifier) (Response, error)
+	RcptTo(ctx context.Context, rcptTo string, m *Modifier) (Response, error)
+	Header(ctx context.Context, name string, value string, m *Modifier) (Response, error)
+	Headers(ctx context.Context, h textproto.MIMEHeader, m *Modifier) (Response, error)
+	BodyChunk(ctx context.Context, chunk []byte, m *Modifier) (Response, error)
+	Body(ctx context.Context, m *Modifier) (Response, error)
+	Disconnect(ctx context.Context)
+}
+
+// The following optional interfaces can be implemented by a SessionHandler or a ContextSessionHandler,
+// handlers get the context with Modifier.Context
+
+// DataHandler can be implemented by a SessionHandler to be called on the DATA command,
+// supress with OptNoData
+type DataHandler interface {
+	Data(m *Modifier) (Response, error)
+}
+
+// UnknownHandler can be implemented by a SessionHandler to be called on unknown or
+// unimplemented SMTP commands, the MTA rejects the command after the handler ran,
+// supress with OptNoUnknown
+type UnknownHandler interface {
+	Unknown(cmd string, m *Modifier) (Response, error)
+}
+
+// MailFromArgsHandler can be implemented by a SessionHandler to receive the ESMTP
+// parameters of MAIL FROM, it is called instead of MailFrom
+type MailFromArgsHandler interface {
+	MailFromArgs(from string, args ESMTPArgs, m *Modifier) (Response, error)
+}
+
+// RcptToArgsHandler can be implemented by a SessionHandler to receive the ESMTP
+// parameters of RCPT TO, it is called instead of RcptTo
+type RcptToArgsHandler interface {
+	RcptToArgs(rcptTo string, args ESMTPArgs, m *Modifier) (Response, error)
+}
+
+// RejectedRcptHandler can be implemented by a SessionHandler to receive recipients the MTA
+// already rejected, it is called instead of RcptTo. Needs OptRcptRej, without a
+// RejectedRcptHandler rejected recipients are skipped.
+type RejectedRcptHandler interface {
+	RejectedRcpt(rcpt RejectedRecipient, m *Modifier) (Response, error)
+}
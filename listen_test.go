@@ -0,0 +1,68 @@
+package milter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenErrors(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	s := New(nil, WithTCPListener(busy.Addr().String()), WithLogger(NopLogger))
+	var opErr *net.OpError
+	if err := s.Run(); !errors.As(err, &opErr) {
+		t.Errorf("expected wrapped listen error from Run, got %v", err)
+	}
+	if err := New(nil, nil).Run(); err != ErrNoListenAddr {
+		t.Errorf("expected ErrNoListenAddr, got %v", err)
+	}
+	if err := s.ListenAndServe(context.Background(), "tcp", busy.Addr().String()); !errors.As(err, &opErr) {
+		t.Errorf("expected wrapped listen error from ListenAndServe, got %v", err)
+	}
+}
+
+func TestListenAndServe(t *testing.T) {
+	factory := func() (SessionHandler, OptAction, OptProtocol, RequestMacros) {
+		return &testHandler{resp: RespContinue}, 0, 0, nil
+	}
+	s := New(factory, nil, WithLogger(NopLogger))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe(ctx, "tcp", "127.0.0.1:0") }()
+
+	// wait until the server accepts connections
+	for i := 0; ; i++ {
+		s.mu.Lock()
+		listener := s.listener
+		s.mu.Unlock()
+		if listener != nil {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err == nil {
+				conn.Close()
+				break
+			}
+		}
+		if i == 100 {
+			t.Fatal("server is not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// cancelling the context stops the server
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not stop")
+	}
+}
@@ -0,0 +1,155 @@
+package milter
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// macroStages maps the command code of a SMFIC_MACRO packet to the Stage of its macros
+var macroStages = map[byte]Stage{
+	SMFIC_CONNECT: SMFIM_CONNECT,
+	SMFIC_HELO:    SMFIM_HELO,
+	SMFIC_MAIL:    SMFIM_ENVFROM,
+	SMFIC_RCPT:    SMFIM_ENVRCPT,
+	SMFIC_DATA:    SMFIM_DATA,
+	SMFIC_EOH:     SMFIM_EOH,
+	SMFIC_BODYEOB: SMFIM_EOM,
+}
+
+// stageOrder lists the stages in the order of the SMTP transaction,
+// macros of later stages hide macros with the same name of earlier stages
+var stageOrder = []Stage{SMFIM_CONNECT, SMFIM_HELO, SMFIM_ENVFROM, SMFIM_ENVRCPT, SMFIM_DATA, SMFIM_EOH, SMFIM_EOM}
+
+// setMacros stores the macros the MTA sent for a stage. Macros for MAIL FROM
+// start a new message and drop the macros of the previous one.
+func (m *milterSession) setMacros(stage Stage, macros map[string]string) {
+	if m.macros == nil {
+		m.macros = make(map[Stage]map[string]string)
+	}
+	if stage == SMFIM_ENVFROM {
+		m.clearMacros(SMFIM_ENVFROM)
+	}
+	m.macros[stage] = macros
+	m.merged, m.stages = nil, nil
+}
+
+// clearMacros removes the macros of stage and all following stages
+func (m *milterSession) clearMacros(from Stage) {
+	drop := false
+	for _, stage := range stageOrder {
+		drop = drop || stage == from
+		if drop {
+			delete(m.macros, stage)
+		}
+	}
+	m.merged, m.stages = nil, nil
+}
+
+// mergedMacros returns all macros of the current connection and message like
+// smfi_getsymval would see them, the most recent stage wins. The map is built once
+// per macro change and never modified afterwards, so Modifiers can share it.
+func (m *milterSession) mergedMacros() map[string]string {
+	if m.merged != nil {
+		return m.merged
+	}
+	m.merged = make(map[string]string)
+	for _, stage := range stageOrder {
+		for name, value := range m.macros[stage] {
+			m.merged[name] = value
+		}
+	}
+	return m.merged
+}
+
+// stageMacros returns the per stage macros, shared like mergedMacros.
+// The maps of the stages are never modified, setMacros replaces them.
+func (m *milterSession) stageMacros() map[Stage]map[string]string {
+	if m.stages != nil {
+		return m.stages
+	}
+	m.stages = make(map[Stage]map[string]string, len(m.macros))
+	for stage, macros := range m.macros {
+		m.stages[stage] = macros
+	}
+	return m.stages
+}
+
+// TLSInfo describes the TLS session of the SMTP client as reported by the MTA
+type TLSInfo struct {
+	Version string // {tls_version}
+	Cipher  string // {cipher}
+	Bits    int    // {cipher_bits}
+	Issuer  string // {cert_issuer}, empty without client certificate
+	Subject string // {cert_subject}, empty without client certificate
+}
+
+// Macro returns the value of a macro, ok is false if the MTA did not provide it up to this stage
+func (m *Modifier) Macro(name Macro) (value string, ok bool) {
+	value, ok = m.Macros[string(name)]
+	return value, ok
+}
+
+// QueueID returns the queue ID of the message, provided by the MTA from DATA on
+func (m *Modifier) QueueID() (string, bool) {
+	return m.nonEmpty(MACRO_QUEUEID)
+}
+
+// AuthUser returns the SASL login name if the client authenticated
+func (m *Modifier) AuthUser() (string, bool) {
+	return m.nonEmpty(MACRO_AUTH_SASL_LOGINNAME)
+}
+
+// ClientAddr returns the IP address of the SMTP client
+func (m *Modifier) ClientAddr() (netip.Addr, bool) {
+	return m.addr(MACRO_REMOTECLIENTIP)
+}
+
+// DaemonAddrPort returns the local IP address and port the SMTP client connected to
+func (m *Modifier) DaemonAddrPort() (netip.AddrPort, bool) {
+	addr, ok := m.addr(MACRO_DAEMON_ADDR)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	value, _ := m.Macro(MACRO_DAEMON_PORT)
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), true
+}
+
+// TLS returns the TLS session details, ok is false if the client did not use TLS
+func (m *Modifier) TLS() (TLSInfo, bool) {
+	version, hasVersion := m.nonEmpty(MACRO_TLS_VERSION)
+	cipher, hasCipher := m.nonEmpty(MACRO_CLIENT_TLS_CIPHER)
+	if !hasVersion && !hasCipher {
+		return TLSInfo{}, false
+	}
+	info := TLSInfo{Version: version, Cipher: cipher}
+	if bits, ok := m.Macro(MACRO_CLIENT_TLS_CIPHER_BITS); ok {
+		info.Bits, _ = strconv.Atoi(bits)
+	}
+	info.Issuer, _ = m.Macro(MACRO_CLIENT_TLS_CERT_ISSUER)
+	info.Subject, _ = m.Macro(MACRO_CLIENT_TLS_CERT_SUBJECT)
+	return info, true
+}
+
+// nonEmpty returns a macro value, treating empty values as not provided
+func (m *Modifier) nonEmpty(name Macro) (string, bool) {
+	value, ok := m.Macro(name)
+	return value, ok && value != ""
+}
+
+// addr parses a macro holding an IP address, Sendmail prefixes IPv6 addresses with "IPv6:"
+func (m *Modifier) addr(name Macro) (netip.Addr, bool) {
+	value, ok := m.nonEmpty(name)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(strings.TrimPrefix(strings.Trim(value, "[]"), "IPv6:"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
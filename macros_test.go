@@ -0,0 +1,104 @@
+package milter
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// macroPacket builds the payload of a SMFIC_MACRO packet
+func macroPacket(code byte, kv ...string) []byte {
+	data := []byte{code}
+	for _, s := range kv {
+		data = append(data, s+null...)
+	}
+	return data
+}
+
+func TestMacroStages(t *testing.T) {
+	m := &milterSession{milter: &testHandler{resp: RespContinue}, logger: NopLogger}
+	process := func(code byte, data []byte) {
+		t.Helper()
+		if _, err := m.Process(&Message{code, data}); err != nil {
+			t.Fatalf("process %c: %v", code, err)
+		}
+	}
+
+	process(SMFIC_MACRO, macroPacket(SMFIC_CONNECT, "{client_addr}", "192.0.2.1", "j", "mx.example.com"))
+	process(SMFIC_MACRO, macroPacket(SMFIC_MAIL, "i", "4711", "{mail_addr}", "from@example.com"))
+	process(SMFIC_MACRO, macroPacket(SMFIC_RCPT, "{rcpt_addr}", "to@example.com"))
+	process(SMFIC_MACRO, macroPacket(SMFIC_BODYEOB, "i", "4712"))
+
+	mod := newModifier(m)
+	if mod.Macros["{client_addr}"] != "192.0.2.1" || mod.Macros["{rcpt_addr}"] != "to@example.com" {
+		t.Errorf("earlier stages missing in merged view: %v", mod.Macros)
+	}
+	if mod.Macros["i"] != "4712" {
+		t.Errorf("latest stage should win, got i=%q", mod.Macros["i"])
+	}
+	if mod.StageMacros(SMFIM_ENVFROM)["i"] != "4711" {
+		t.Errorf("unexpected per stage macros %v", mod.StageMacros(SMFIM_ENVFROM))
+	}
+
+	// the next message drops the macros of the previous one
+	process(SMFIC_MACRO, macroPacket(SMFIC_MAIL, "{mail_addr}", "other@example.com"))
+	mod = newModifier(m)
+	if _, ok := mod.Macros["{rcpt_addr}"]; ok {
+		t.Errorf("macros of previous message still visible: %v", mod.Macros)
+	}
+	if _, ok := mod.Macros["i"]; ok {
+		t.Errorf("macros of previous message still visible: %v", mod.Macros)
+	}
+	if mod.Macros["j"] != "mx.example.com" {
+		t.Errorf("connection macros lost: %v", mod.Macros)
+	}
+
+	process(SMFIC_ABORT, nil)
+	if mod = newModifier(m); len(mod.Macros) != 2 || mod.StageMacros(SMFIM_ENVFROM) != nil {
+		t.Errorf("abort should only keep connection macros: %v", mod.Macros)
+	}
+
+	process(SMFIC_QUIT_NC, nil)
+	if mod = newModifier(m); len(mod.Macros) != 0 {
+		t.Errorf("new connection should start without macros: %v", mod.Macros)
+	}
+}
+
+func TestMacroAccessors(t *testing.T) {
+	m := &Modifier{Macros: map[string]string{
+		"i":              "4711",
+		"{auth_authen}":  "",
+		"{client_addr}":  "IPv6:2001:db8::1",
+		"{daemon_addr}":  "192.0.2.25",
+		"{daemon_port}":  "25",
+		"{tls_version}":  "TLSv1.3",
+		"{cipher}":       "TLS_AES_256_GCM_SHA384",
+		"{cipher_bits}":  "256",
+		"{cert_subject}": "CN=client",
+		"{unrelated}":    "x",
+	}}
+
+	if id, ok := m.QueueID(); !ok || id != "4711" {
+		t.Errorf("QueueID: got %q %v", id, ok)
+	}
+	if user, ok := m.AuthUser(); ok {
+		t.Errorf("AuthUser: empty macro should not be provided, got %q", user)
+	}
+	if addr, ok := m.ClientAddr(); !ok || addr != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("ClientAddr: got %v %v", addr, ok)
+	}
+	if ap, ok := m.DaemonAddrPort(); !ok || ap != netip.MustParseAddrPort("192.0.2.25:25") {
+		t.Errorf("DaemonAddrPort: got %v %v", ap, ok)
+	}
+	info, ok := m.TLS()
+	if !ok || info.Version != "TLSv1.3" || info.Bits != 256 || info.Subject != "CN=client" || info.Issuer != "" {
+		t.Errorf("TLS: got %+v %v", info, ok)
+	}
+
+	empty := &Modifier{}
+	if _, ok := empty.ClientAddr(); ok {
+		t.Errorf("ClientAddr without macros should not be provided")
+	}
+	if _, ok := empty.TLS(); ok {
+		t.Errorf("TLS without macros should not be provided")
+	}
+}
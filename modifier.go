@@ -4,45 +4,165 @@ package milter
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net/textproto"
 )
 
 // Modifier provides access to Macros, Headers and Body data to callback handlers. It also defines a
 // number of functions that can be used by callback handlers to modify processing of the email message
 type Modifier struct {
-	Macros      map[string]string
-	Headers     textproto.MIMEHeader
-	writePacket func(*Message) error
+	// Macros holds the macros of all stages of the current connection and message,
+	// if a macro was sent in several stages the value of the latest stage is used
+	Macros  map[string]string
+	Headers textproto.MIMEHeader
+	stages  map[Stage]map[string]string
+	session *milterSession
+	ctx     context.Context
+	token   uint64 // command the Modifier was created for
+}
+
+// Context returns the context of the current message or SMTP connection,
+// see ContextSessionHandler
+func (m *Modifier) Context() context.Context {
+	return m.ctx
+}
+
+// StageMacros returns the macros the MTA sent for a single stage,
+// nil if it sent none for this stage in the current connection and message
+func (m *Modifier) StageMacros(stage Stage) map[string]string {
+	return m.stages[stage]
+}
+
+// Actions returns the actions negotiated with the MTA,
+// the accessors of negotiated values return zero values for a Modifier without session
+func (m *Modifier) Actions() OptAction {
+	if m.session == nil {
+		return OptNone
+	}
+	return m.session.actions
+}
+
+// HasAction reports whether all given actions were negotiated with the MTA
+func (m *Modifier) HasAction(action OptAction) bool {
+	return m.Actions()&action == action
+}
+
+// Protocol returns the protocol options negotiated with the MTA
+func (m *Modifier) Protocol() OptProtocol {
+	if m.session == nil {
+		return 0
+	}
+	return m.session.protocol
+}
+
+// ProtocolVersion returns the milter protocol version negotiated with the MTA
+func (m *Modifier) ProtocolVersion() uint32 {
+	if m.session == nil {
+		return 0
+	}
+	return m.session.version
+}
+
+// MaxDataSize returns the maximum size of body chunks and body replacement packets
+func (m *Modifier) MaxDataSize() int {
+	if m.session == nil {
+		return 0
+	}
+	if m.session.maxDataSize == 0 {
+		return MaxDataSize64K
+	}
+	return m.session.maxDataSize
+}
+
+// action sends a modification packet to the MTA after checking that the required
+// action was negotiated and that the session is at end of message
+func (m *Modifier) action(required OptAction, msg *Message) error {
+	if !m.HasAction(required) {
+		return fmt.Errorf("%w: %c needs 0x%x", ErrActionNotNegotiated, msg.Code, uint32(required))
+	}
+	return m.session.writePacketAt(m.token, SMFIC_BODYEOB, msg)
+}
+
+// Progress tells the MTA that the end of message handler is still working,
+// so it does not time out. It is safe to call from other goroutines.
+func (m *Modifier) Progress() error {
+	if m.session == nil {
+		return ErrWrongStage
+	}
+	return m.session.writePacketAt(m.token, SMFIC_BODYEOB, respProgress.Response())
 }
 
 // AddRecipient appends a new envelope recipient for current message
 func (m *Modifier) AddRecipient(r string) error {
 	data := []byte(fmt.Sprintf("<%s>", r) + null)
-	return m.writePacket(NewResponse(SMFIR_ADDRCPT, data).Response())
+	return m.action(OptAddRcpt, NewResponse(SMFIR_ADDRCPT, data).Response())
+}
+
+// AddRecipientWithArgs appends a new envelope recipient with ESMTP parameters, e.g. "NOTIFY=NEVER",
+// needs OptAddRcptPartial
+func (m *Modifier) AddRecipientWithArgs(r string, args string) error {
+	data := []byte(fmt.Sprintf("<%s>", r) + null + args + null)
+	return m.action(OptAddRcptPartial, NewResponse(SMFIR_ADDRCPT_PAR, data).Response())
 }
 
 // DeleteRecipient removes an envelope recipient address from message
 func (m *Modifier) DeleteRecipient(r string) error {
 	data := []byte(fmt.Sprintf("<%s>", r) + null)
-	return m.writePacket(NewResponse(SMFIR_DELRCPT, data).Response())
+	return m.action(OptRemoveRcpt, NewResponse(SMFIR_DELRCPT, data).Response())
 }
 
-// ReplaceBody substitutes message body with provided body
+// ReplaceBody substitutes message body with provided body,
+// bodies larger than MaxDataSize are sent in several packets
 func (m *Modifier) ReplaceBody(body []byte) error {
-	return m.writePacket(NewResponse(SMFIR_REPLBODY, body).Response())
+	size := m.MaxDataSize()
+	for {
+		chunk := body
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if err := m.action(OptChangeBody, NewResponse(SMFIR_REPLBODY, chunk).Response()); err != nil {
+			return err
+		}
+		body = body[len(chunk):]
+		if len(body) == 0 {
+			return nil
+		}
+	}
+}
+
+// ReplaceBodyFrom substitutes message body with the content of r,
+// it is read and sent in packets of MaxDataSize
+func (m *Modifier) ReplaceBodyFrom(r io.Reader) error {
+	buffer := make([]byte, m.MaxDataSize())
+	for first := true; ; first = false {
+		n, err := io.ReadFull(r, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// an empty reader still replaces the body with an empty one
+		if n > 0 || first {
+			if err := m.action(OptChangeBody, NewResponse(SMFIR_REPLBODY, buffer[:n]).Response()); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
 }
 
 // AddHeader appends a new email message header the message
 func (m *Modifier) AddHeader(name, value string) error {
 	data := []byte(name + null + value + null)
-	return m.writePacket(NewResponse(SMFIR_ADDHEADER, data).Response())
+	return m.action(OptAddHeader, NewResponse(SMFIR_ADDHEADER, data).Response())
 }
 
 // Quarantine a message by giving a reason to hold it
 func (m *Modifier) Quarantine(reason string) error {
-	return m.writePacket(NewResponse(SMFIR_QUARANTINE, []byte(reason+null)).Response())
+	return m.action(OptQuarantine, NewResponse(SMFIR_QUARANTINE, []byte(reason+null)).Response())
 }
 
 // ChangeHeader replaces the header at the specified position with a new one
@@ -58,7 +178,7 @@ func (m *Modifier) ChangeHeader(index int, name, value string) error {
 		return err
 	}
 	// prepare and send response packet
-	return m.writePacket(NewResponse(SMFIR_CHGHEADER, buffer.Bytes()).Response())
+	return m.action(OptChangeHeader, NewResponse(SMFIR_CHGHEADER, buffer.Bytes()).Response())
 }
 
 // InsertHeader inserts the header at the pecified position
@@ -74,26 +194,55 @@ func (m *Modifier) InsertHeader(index int, name, value string) error {
 		return err
 	}
 	// prepare and send response packet
-	return m.writePacket(NewResponse(SMFIR_INSHEADER, buffer.Bytes()).Response())
+	return m.action(OptAddHeader, NewResponse(SMFIR_INSHEADER, buffer.Bytes()).Response())
 }
 
 // ChangeFrom replaces the FROM envelope header with a new one
 func (m *Modifier) ChangeFrom(value string) error {
+	return m.ChangeFromWithArgs(value, "")
+}
+
+// ChangeFromWithArgs replaces the FROM envelope header and its ESMTP parameters, e.g. "RET=HDRS"
+func (m *Modifier) ChangeFromWithArgs(value string, args string) error {
 	buffer := new(bytes.Buffer)
-	// add header name and value to buffer
+	// add address and optional parameters to buffer
 	data := []byte(value + null)
+	if args != "" {
+		data = append(data, args+null...)
+	}
 	if _, err := buffer.Write(data); err != nil {
 		return err
 	}
 	// prepare and send response packet
-	return m.writePacket(NewResponse(SMFIR_CHGFROM, buffer.Bytes()).Response())
+	return m.action(OptChangeFrom, NewResponse(SMFIR_CHGFROM, buffer.Bytes()).Response())
+}
+
+// cloneHeader copies h, so a handler that may be abandoned after its timeout
+// never reads headers the session adds for later commands
+func cloneHeader(h textproto.MIMEHeader) textproto.MIMEHeader {
+	if h == nil {
+		return nil
+	}
+	clone := make(textproto.MIMEHeader, len(h))
+	for name, values := range h {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
 }
 
 // newModifier creates a new Modifier instance from milterSession
 func newModifier(s *milterSession) *Modifier {
+	macros := s.mergedMacros()
+	headers := s.headers
+	if _, ok := s.handlerTimeout(s.stage()); ok {
+		headers = cloneHeader(headers)
+	}
 	return &Modifier{
-		Macros:      s.macros,
-		Headers:     s.headers,
-		writePacket: s.WritePacket,
+		Macros:  macros,
+		stages:  s.stageMacros(),
+		Headers: headers,
+		session: s,
+		ctx:     context.WithValue(s.context(), macrosKey, macros),
+		token:   s.token(),
 	}
 }
@@ -0,0 +1,100 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// optMaxDataSize are protocol flags the MTA may decline without breaking the filter,
+// the session falls back to the default data size instead
+const optMaxDataSize = OptMDS256K | OptMDS1M
+
+// negotiate parses the SMFIC_OPTNEG offer of the MTA, intersects it with the
+// actions and protocol options requested by the MilterFactory and builds the reply
+func (m *milterSession) negotiate(data []byte) (Response, error) {
+	mtaVersion, mtaActions, mtaProtocol, err := decodeOptNeg(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if mtaVersion < SMFI_PROT_VERSION_MIN {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, mtaVersion)
+	}
+	// answer with the highest version both sides understand
+	version := mtaVersion
+	if version > SMFI_PROT_VERSION {
+		version = SMFI_PROT_VERSION
+	}
+
+	// SETSYMLIST is decided below together with the requested macros
+	actions := m.actions
+	if missing := actions &^ mtaActions &^ OptSetSymList; missing != 0 {
+		if !m.fallback {
+			return nil, fmt.Errorf("%w: 0x%x", ErrUnsupportedActions, uint32(missing))
+		}
+		m.logger.Printf("MTA does not offer actions 0x%x, continuing without them", uint32(missing))
+		actions &= mtaActions
+	}
+
+	protocol := m.protocol
+	if missing := protocol &^ mtaProtocol &^ optMaxDataSize; missing != 0 {
+		if !m.fallback {
+			return nil, fmt.Errorf("%w: 0x%x", ErrUnsupportedProtocol, uint32(missing))
+		}
+		m.logger.Printf("MTA does not offer protocol options 0x%x, continuing without them", uint32(missing))
+	}
+	protocol &= mtaProtocol
+
+	// requested macros need protocol version 6 and the SETSYMLIST action,
+	// without them the MTA sends its default macros
+	symlists := m.symlists
+	if version < 6 || mtaActions&OptSetSymList == 0 {
+		if len(symlists) > 0 {
+			m.logger.Printf("MTA does not support requesting macros, using its defaults")
+		}
+		symlists = nil
+		actions &^= OptSetSymList
+	} else if len(symlists) > 0 {
+		actions |= OptSetSymList
+	}
+
+	m.version, m.actions, m.protocol = version, actions, protocol
+	switch {
+	case protocol&OptMDS1M != 0:
+		m.maxDataSize = MaxDataSize1M
+	case protocol&OptMDS256K != 0:
+		m.maxDataSize = MaxDataSize256K
+	default:
+		m.maxDataSize = MaxDataSize64K
+	}
+
+	// prepare response data
+	buffer := new(bytes.Buffer)
+	for _, value := range []uint32{version, uint32(actions), uint32(protocol)} {
+		if err := binary.Write(buffer, binary.BigEndian, value); err != nil {
+			return nil, err
+		}
+	}
+
+	// addsymlist to buffer
+	for stage, macros := range symlists {
+		if err := binary.Write(buffer, binary.BigEndian, uint32(stage)); err != nil {
+			return nil, err
+		}
+		var macrosStrSlice []string
+		for _, macro := range macros {
+			macrosStrSlice = append(macrosStrSlice, string(macro))
+		}
+		macrosStr := strings.Join(macrosStrSlice, " ")
+		// add macro names to buffer
+		data := []byte(macrosStr + null)
+		if _, err := buffer.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	// build and send packet
+	return NewResponse(SMFIC_OPTNEG, buffer.Bytes()), nil
+}
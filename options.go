@@ -1,8 +1,9 @@
 package milter
 
 import (
-	"log"
 	"net"
+	"os"
+	"time"
 )
 
 // An Option configures a Server using the functional options paradigm
@@ -39,35 +40,141 @@ func WithListener(listener net.Listener) ListenerOption {
 	})
 }
 
-// WithTCPListener e.g. "127.0.0.1:12349"
-func WithTCPListener(address string) ListenerOption {
-	protocol := "tcp"
-	// bind to listening address
-	socket, err := net.Listen(protocol, address)
-	if err != nil {
-		log.Fatal(err)
-	}
+// WithListenAddress lets Run listen on address of network, e.g. "tcp" or "unix",
+// errors are returned by Run instead of ending the process. The address is only bound
+// once Run is called, use WithListener if clients must be able to connect before.
+func WithListenAddress(network, address string) ListenerOption {
+	return loptionFunc(func(server *Server) {
+		server.network, server.address = network, address
+	})
+}
 
-	return WithListener(socket)
+// WithTCPListener e.g. "127.0.0.1:12349", the address is bound by Run, not by New,
+// Run returns an error if the address can not be bound
+func WithTCPListener(address string) ListenerOption {
+	return WithListenAddress("tcp", address)
 }
 
 // WithUnixSocket e.g. "/var/spool/postfix/var/run/milter/milter.sock"
-// make sure that the file does not exist!
+// a stale socket of a previous run is replaced, Run fails with ErrSocketInUse
+// if another process still listens on it. To find out, Run connects to the socket,
+// a running instance sees this as an empty milter session. The socket is removed on Close.
 func WithUnixSocket(file string) ListenerOption {
-	protocol := "unix"
-	// bind to listening address
-	socket, err := net.Listen(protocol, file)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return WithListenAddress("unix", file)
+}
 
-	return WithListener(socket)
+// WithUnixSocketMode sets the file mode of the Unix socket, e.g. 0660
+// to let the MTA connect through its group
+func WithUnixSocketMode(mode os.FileMode) Option {
+	return optionFunc(func(server *Server) {
+		server.socketMode = mode
+	})
+}
+
+// WithUnixSocketOwner sets owner and group of the Unix socket, -1 keeps the current one
+func WithUnixSocketOwner(uid, gid int) Option {
+	return optionFunc(func(server *Server) {
+		server.socketOwner = true
+		server.socketUID, server.socketGID = uid, gid
+	})
 }
 
 // WithPanicHandler Adds the error panic handler
-// Multiple panic handlers are supported
+// Multiple panic handlers are supported, panics of milter handlers are passed as *PanicError
 func WithPanicHandler(handler func(error)) Option {
 	return optionFunc(func(server *Server) {
 		server.errHandlers = append(server.errHandlers, handler)
 	})
 }
+
+// WithNegotiationFallback lets sessions continue with the actions and protocol options
+// the MTA offered, instead of closing the connection when it cannot provide everything
+// the MilterFactory requested
+func WithNegotiationFallback() Option {
+	return optionFunc(func(server *Server) {
+		server.fallback = true
+	})
+}
+
+// WithProgressInterval sends progress packets to the MTA in the given interval
+// while the Body handler is running, to keep slow handlers from hitting MTA timeouts
+func WithProgressInterval(interval time.Duration) Option {
+	return optionFunc(func(server *Server) {
+		server.progress = interval
+	})
+}
+
+// WithMaxPacketSize limits the size of packets accepted from the MTA,
+// the default is DefaultMaxPacketSize
+func WithMaxPacketSize(size uint32) Option {
+	return optionFunc(func(server *Server) {
+		server.maxPacketSize = size
+	})
+}
+
+// WithErrorHook adds a function called with errors ending a session, like ErrTimeout.
+// Multiple error hooks are supported
+func WithErrorHook(hook func(error)) Option {
+	return optionFunc(func(server *Server) {
+		server.errorHooks = append(server.errorHooks, hook)
+	})
+}
+
+// WithIdleTimeout closes connections when the MTA sends no command for the given duration
+func WithIdleTimeout(timeout time.Duration) Option {
+	return optionFunc(func(server *Server) {
+		server.idleTimeout = timeout
+	})
+}
+
+// WithReadTimeout closes connections when reading a started packet takes longer than the given duration
+func WithReadTimeout(timeout time.Duration) Option {
+	return optionFunc(func(server *Server) {
+		server.readTimeout = timeout
+	})
+}
+
+// WithWriteTimeout closes connections when writing a packet to the MTA takes longer than the given duration
+func WithWriteTimeout(timeout time.Duration) Option {
+	return optionFunc(func(server *Server) {
+		server.writeTimeout = timeout
+	})
+}
+
+// WithHandlerTimeout limits the run time of the handlers of the given command codes (SMFIC_*),
+// or of all handlers if no command is given. When the timeout passes the handler context is
+// cancelled and resp is sent to the MTA instead, e.g. RespContinue to fail open or
+// RespTempFail to fail closed. A nil resp sends RespTempFail.
+func WithHandlerTimeout(timeout time.Duration, resp Response, cmds ...byte) Option {
+	return optionFunc(func(server *Server) {
+		if resp == nil {
+			resp = RespTempFail
+		}
+		if server.handlerTimeouts == nil {
+			server.handlerTimeouts = make(map[byte]handlerTimeout)
+		}
+		if len(cmds) == 0 {
+			cmds = []byte{0}
+		}
+		for _, cmd := range cmds {
+			server.handlerTimeouts[cmd] = handlerTimeout{timeout, resp}
+		}
+	})
+}
+
+// WithPanicResponse sets the response sent to the MTA when a milter handler panics,
+// the default is RespTempFail
+func WithPanicResponse(resp Response) Option {
+	return optionFunc(func(server *Server) {
+		server.panicResponse = resp
+	})
+}
+
+// WithErrorPolicy maps errors returned by handlers to the response sent to the MTA, e.g.
+// RespTempFail for lookup failures. Errors created with TempFail or Reject carry their own
+// response and do not reach policy. A nil response closes the milter connection.
+func WithErrorPolicy(policy func(error) Response) Option {
+	return optionFunc(func(server *Server) {
+		server.errorPolicy = policy
+	})
+}
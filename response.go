@@ -1,5 +1,11 @@
 package milter
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
 // Response represents a response structure returned by callback
 // handlers to indicate how the milter server should proceed
 type Response interface {
@@ -15,9 +21,9 @@ func (r SimpleResponse) Response() *Message {
 	return &Message{byte(r), nil}
 }
 
-// Continue to process milter messages only if current code is Continue
+// Continue to process milter messages only if current code is Continue or Skip
 func (r SimpleResponse) Continue() bool {
-	return byte(r) == SMFIR_CONTINUE
+	return byte(r) == SMFIR_CONTINUE || byte(r) == SMFIR_SKIP
 }
 
 // Define standard responses with no data
@@ -27,6 +33,14 @@ const (
 	RespDiscard  = SimpleResponse(SMFIR_DISCARD)
 	RespReject   = SimpleResponse(SMFIR_REJECT)
 	RespTempFail = SimpleResponse(SMFIR_TEMPFAIL)
+	// RespShutdown lets the MTA close the SMTP connection with a 421 reply
+	RespShutdown = SimpleResponse(SMFIR_SHUTDOWN)
+	// RespConnFail lets the MTA fail the SMTP connection
+	RespConnFail = SimpleResponse(SMFIR_CONN_FAIL)
+	// RespSkip can be returned by BodyChunk to stop receiving body chunks, needs OptSkip
+	RespSkip = SimpleResponse(SMFIR_SKIP)
+	// respProgress is sent by Modifier.Progress and the keepalive, it is no valid handler response
+	respProgress = SimpleResponse(SMFIR_PROGRESS)
 )
 
 // CustomResponse is a response instance used by callback handlers to indicate
@@ -43,7 +57,7 @@ func (c *CustomResponse) Response() *Message {
 
 // Continue returns false if milter chain should be stopped, true otherwise
 func (c *CustomResponse) Continue() bool {
-	for _, q := range []byte{SMFIR_ACCEPT, SMFIR_DISCARD, SMFIR_REJECT, SMFIR_TEMPFAIL} {
+	for _, q := range []byte{SMFIR_ACCEPT, SMFIR_DISCARD, SMFIR_REJECT, SMFIR_TEMPFAIL, SMFIR_SHUTDOWN, SMFIR_CONN_FAIL} {
 		if c.code == q {
 			return false
 		}
@@ -59,6 +73,66 @@ func NewResponse(code byte, data []byte) *CustomResponse {
 // NewResponseStr generates a new CustomResponse with string payload
 // code should be SMFIR_REPLYCODE == 'y'
 // data can be "550 5.2.0 mailbox unavailable."
+// Reply builds and validates such responses
 func NewResponseStr(code byte, data string) *CustomResponse {
 	return NewResponse(code, []byte(data+null))
 }
+
+// maxReplyLines is the number of lines smfi_setmlreply accepts
+const maxReplyLines = 32
+
+// enhancedStatus matches RFC 3463 enhanced status codes
+var enhancedStatus = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}$`)
+
+// Reply generates a SMFIR_REPLYCODE response like smfi_setreply and smfi_setmlreply do.
+// code has to be a 4xx or 5xx SMTP reply code, enhanced an optional enhanced status code
+// of the same class, e.g. Reply(550, "5.7.1", "message rejected"). Multiple lines are sent
+// as multi-line reply, '%' characters are escaped.
+func Reply(code int, enhanced string, lines ...string) (*CustomResponse, error) {
+	if code < 400 || code > 599 {
+		return nil, fmt.Errorf("%w: reply code %d is not 4xx or 5xx", ErrInvalidReply, code)
+	}
+	if enhanced != "" {
+		if !enhancedStatus.MatchString(enhanced) {
+			return nil, fmt.Errorf("%w: malformed enhanced status code %q", ErrInvalidReply, enhanced)
+		}
+		if int(enhanced[0]-'0') != code/100 {
+			return nil, fmt.Errorf("%w: enhanced status code %s does not match reply code %d", ErrInvalidReply, enhanced, code)
+		}
+	}
+	if len(lines) > maxReplyLines {
+		return nil, fmt.Errorf("%w: %d lines, at most %d allowed", ErrInvalidReply, len(lines), maxReplyLines)
+	}
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+
+	reply := new(strings.Builder)
+	for i, line := range lines {
+		// line breaks split the reply, NUL would cut it off
+		if strings.ContainsAny(line, "\r\n\x00") {
+			return nil, fmt.Errorf("%w: line %d contains a line break or NUL", ErrInvalidReply, i+1)
+		}
+		var text []string
+		if enhanced != "" {
+			text = append(text, enhanced)
+		}
+		if line != "" {
+			text = append(text, strings.ReplaceAll(line, "%", "%%"))
+		}
+		// all but the last line are continued with a dash,
+		// the last one ends after the code if it has no text
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+			if len(text) == 0 {
+				sep = ""
+			}
+		}
+		fmt.Fprintf(reply, "%d%s%s", code, sep, strings.Join(text, " "))
+		if i < len(lines)-1 {
+			reply.WriteString("\r\n")
+		}
+	}
+	return NewResponseStr(SMFIR_REPLYCODE, reply.String()), nil
+}
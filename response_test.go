@@ -0,0 +1,48 @@
+package milter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReply(t *testing.T) {
+	tests := []struct {
+		code     int
+		enhanced string
+		lines    []string
+		want     string
+		err      bool
+	}{
+		{550, "5.7.1", []string{"message rejected"}, "550 5.7.1 message rejected", false},
+		{451, "", []string{"try again later"}, "451 try again later", false},
+		{554, "5.7.1", nil, "554 5.7.1", false},
+		{550, "5.7.1", []string{"100% spam"}, "550 5.7.1 100%% spam", false},
+		{550, "5.7.1", []string{"first", "second", "third"},
+			"550-5.7.1 first\r\n550-5.7.1 second\r\n550 5.7.1 third", false},
+		{250, "2.0.0", []string{"ok"}, "", true},
+		{550, "4.7.1", []string{"class mismatch"}, "", true},
+		{550, "5.7", []string{"malformed"}, "", true},
+		{550, "5.7.1", []string{"line\r\nbreak"}, "", true},
+		{550, "5.7.1", []string{"a\x00b"}, "", true},
+		{550, "", nil, "550", false},
+		{550, "5.7.1", []string{"trailing space "}, "550 5.7.1 trailing space ", false},
+		{550, "5.7.1", make([]string, 33), "", true},
+	}
+	for _, tt := range tests {
+		resp, err := Reply(tt.code, tt.enhanced, tt.lines...)
+		if tt.err {
+			if !errors.Is(err, ErrInvalidReply) {
+				t.Errorf("Reply(%d, %q, %q): expected ErrInvalidReply, got %v", tt.code, tt.enhanced, tt.lines, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Reply(%d, %q, %q): unexpected error %v", tt.code, tt.enhanced, tt.lines, err)
+			continue
+		}
+		msg := resp.Response()
+		if msg.Code != SMFIR_REPLYCODE || string(msg.Data) != tt.want+null {
+			t.Errorf("Reply(%d, %q, %q): expected %q, got %c %q", tt.code, tt.enhanced, tt.lines, tt.want, msg.Code, msg.Data)
+		}
+	}
+}
@@ -2,9 +2,11 @@
 package milter
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
@@ -24,13 +26,36 @@ func Close() {
 // support panic handling via ErrHandler
 // couple of func(error) could be provided for handling error
 type Server struct {
-	listener      net.Listener
-	milterFactory MilterFactory
-	errHandlers   []func(error)
-	logger        CustomLogger
-	wg            sync.WaitGroup
-	quit          chan struct{}
-	exited        chan struct{}
+	listener        net.Listener
+	network         string // network and address Run listens on without listener
+	address         string
+	socketMode      os.FileMode // mode and owner of Unix sockets the server creates
+	socketOwner     bool
+	socketUID       int
+	socketGID       int
+	milterFactory   MilterFactory
+	errHandlers     []func(error)
+	errorHooks      []func(error)
+	idleTimeout     time.Duration
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	handlerTimeouts map[byte]handlerTimeout
+	panicResponse   Response
+	errorPolicy     func(error) Response
+	fallback        bool
+	progress        time.Duration
+	maxPacketSize   uint32
+	logger          CustomLogger
+	wg              sync.WaitGroup
+	ctx             context.Context // parent of all session contexts, cancelled by Close
+	cancel          context.CancelFunc
+	initOnce        sync.Once
+	mu              sync.Mutex
+	conns           map[net.Conn]*milterSession // open connections, the session is set once it started
+	shutdown        bool
+	quit            chan struct{}
+	forced          chan struct{} // closed when Shutdown gave up waiting for sessions
+	forceOnce       sync.Once
 }
 
 // New generates a new Server
@@ -40,82 +65,253 @@ func New(milterfactory MilterFactory, lopt ListenerOption, opts ...Option) *Serv
 		logger:        stdoutLogger{},
 		wg:            sync.WaitGroup{},
 	}
-	lopt.lapply(server)
+	server.init()
+	if lopt != nil {
+		lopt.lapply(server)
+	}
 	for _, opt := range opts {
 		opt.apply(server)
 	}
 	return server
 }
 
+// init creates the base context and the shutdown state, so Close and Shutdown
+// can also be called on a Server that was never started
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.conns = make(map[net.Conn]*milterSession)
+		s.quit = make(chan struct{})
+		s.forced = make(chan struct{})
+	})
+}
+
 // RequestMacros - Also known as SetSymList: the list of macros that the milter wants to receive from the MTA for a protocol Stage (stages has the prefix SMFIM_).
 // if nil, then there are not Macros requested and the default macros from MTA are used.
 type RequestMacros map[Stage][]Macro
 
+// ShutdownError is returned by Shutdown when its context ended before all sessions finished
+type ShutdownError struct {
+	Closed int   // number of connections closed while processing a message
+	Err    error // error of the context
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("milter shutdown: closed %d active connections: %v", e.Closed, e.Err)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
 // Close for graceful shutdown
-// Stop accepting new connections
+// Stop accepting new connections, cancel the contexts of ContextSessionHandlers
 // And wait until processing connections ends
 func (s *Server) Close() error {
-	close(s.quit)
-	s.listener.Close()
-	<-s.exited
-	return nil
+	s.init()
+	s.cancel()
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting new connections and waits until the open sessions finished
+// their current message, sessions between messages are closed right away. If ctx ends
+// first the remaining connections are closed, the contexts of ContextSessionHandlers
+// are cancelled and a *ShutdownError is returned. It can be called several times.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.init()
+	s.mu.Lock()
+	if !s.shutdown {
+		s.shutdown = true
+		close(s.quit)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	}
+	for _, session := range s.conns {
+		if session != nil {
+			session.wake()
+		}
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.sessionsDone():
+		return nil
+	case <-ctx.Done():
+	}
+
+	// handlers still running are not waited for, they see the cancelled context
+	s.mu.Lock()
+	closed := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.cancel()
+	s.forceOnce.Do(func() { close(s.forced) })
+	return &ShutdownError{Closed: closed, Err: ctx.Err()}
 }
 
-// Run starts milter server via provided listener
+// Run starts milter server via provided listener,
+// or listens on the address set with WithListenAddress
 func (s *Server) Run() error {
-	if s.listener == nil {
-		return ErrNoListenAddr
+	s.init()
+	listener := s.listener
+	if listener == nil {
+		if s.address == "" {
+			return ErrNoListenAddr
+		}
+		var err error
+		if listener, err = s.listen(context.Background(), s.network, s.address); err != nil {
+			return err
+		}
 	}
-	s.quit = make(chan struct{})
-	s.exited = make(chan struct{})
-	for {
+	return s.serve(listener)
+}
+
+// ListenAndServe listens on address of network and serves milter connections,
+// cancelling ctx closes the server like Close. Errors while listening are returned
+// wrapped, so callers can inspect them with errors.As and retry.
+func (s *Server) ListenAndServe(ctx context.Context, network, address string) error {
+	s.init()
+	listener, err := s.listen(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	go func() {
 		select {
+		case <-ctx.Done():
+			s.Close()
 		case <-s.quit:
-			s.wg.Wait()
-			close(s.exited)
-			return nil
-		default:
-			conn, err := s.listener.Accept()
-			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-					continue
+		}
+	}()
+	return s.serve(listener)
+}
+
+// listen binds address of network
+func (s *Server) listen(ctx context.Context, network, address string) (net.Listener, error) {
+	if network == "unix" {
+		return s.listenUnix(ctx, address)
+	}
+	var config net.ListenConfig
+	listener, err := config.Listen(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("milter: %w", err)
+	}
+	return listener, nil
+}
+
+// serve accepts connections of listener until the server shuts down
+func (s *Server) serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				// after a forced shutdown handlers still running are not waited for
+				select {
+				case <-s.sessionsDone():
+				case <-s.forced:
 				}
-				s.logger.Printf("Error: Failed to accept connection: %s", err.Error())
-				time.Sleep(200 * time.Millisecond)
-				continue
+				return nil
+			default:
 			}
-			if conn == nil {
-				s.logger.Printf("Error: conn is nil")
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 				continue
 			}
-			s.wg.Add(1)
-			go func() {
-				defer handlePanic(s.errHandlers)
-				defer s.wg.Done()
-				s.handleCon(conn)
-			}()
+			s.logger.Printf("Error: Failed to accept connection: %s", err.Error())
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		if conn == nil {
+			s.logger.Printf("Error: conn is nil")
+			continue
 		}
+		if !s.track(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer handlePanic(s.errHandlers)
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handleCon(conn)
+		}()
 	}
 }
 
+// sessionsDone returns a channel that is closed when all sessions ended
+func (s *Server) sessionsDone() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// track adds an accepted connection, it returns false once the server shuts down
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	s.wg.Add(1)
+	s.conns[conn] = nil
+	return true
+}
+
+// untrack removes a connection whose session ended
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
 // Handle incoming connections
 func (s *Server) handleCon(conn net.Conn) {
 	// create milter object
 	milter, actions, protocol, requestmacros := s.milterFactory()
 
-	session := milterSession{
-		actions:  actions,
-		protocol: protocol,
-		sock:     conn,
-		milter:   milter,
-		logger:   s.logger,
-		symlists: requestmacros,
+	session := &milterSession{
+		actions:         actions,
+		protocol:        protocol,
+		fallback:        s.fallback,
+		progress:        s.progress,
+		maxPacketSize:   s.maxPacketSize,
+		idleTimeout:     s.idleTimeout,
+		readTimeout:     s.readTimeout,
+		writeTimeout:    s.writeTimeout,
+		errorHooks:      s.errorHooks,
+		handlerTimeouts: s.handlerTimeouts,
+		panicHandlers:   s.errHandlers,
+		panicResponse:   s.panicResponse,
+		errorPolicy:     s.errorPolicy,
+		baseCtx:         s.ctx,
+		quit:            s.quit,
+		sock:            conn,
+		milter:          milter,
+		logger:          s.logger,
+		symlists:        requestmacros,
 	}
+	s.mu.Lock()
+	s.conns[conn] = session
+	s.mu.Unlock()
 	// handle connection commands
 	session.HandleMilterCommands()
 }
 
-// Recover panic from session and call handle with occurred error
+// Recover panic from session and call handle with occurred error, panics of milter
+// handlers are already recovered by the session, this catches the MilterFactory
 // If no any handle provided panics will not recovered
 func handlePanic(handlers []func(error)) {
 	var err error
@@ -126,8 +126,14 @@ func TestMilterClient(t *testing.T) {
 			0,
 			setsymlist
 	}
+	// bind before Run, WithTCPListener would only listen once Run is called
+	// and SendEml below could connect before that
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
 	m := milter.New(milterfactory,
-		milter.WithTCPListener("127.0.0.1:12349"),
+		milter.WithListener(listener),
 		milter.WithLogger(milter.StdOutLogger),
 		milter.WithPanicHandler(panichandler),
 	)
@@ -156,7 +162,7 @@ func TestMilterClient(t *testing.T) {
 	bigmailreader := io.MultiReader(eml, bytes.NewReader(b))
 
 	msgID := milterclient.GenMtaID(12)
-	last, err := milterclient.SendEml(bigmailreader, "127.0.0.1:12349", "from@unittest.de", "to@unittest.de", "", "", msgID, false, 5)
+	last, err := milterclient.SendEml(bigmailreader, listener.Addr().String(), "from@unittest.de", "to@unittest.de", "", "", msgID, false, 5)
 	if err != nil {
 		t.Errorf("Error sending eml to milter: %v", err)
 	}
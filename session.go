@@ -2,28 +2,65 @@ package milter
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"net/textproto"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // milterSession keeps session state during MTA communication
 type milterSession struct {
-	actions   OptAction
-	protocol  OptProtocol
-	sock      io.ReadWriteCloser
-	headers   textproto.MIMEHeader
-	macros    map[string]string
-	symlists  RequestMacros
-	milter    SessionHandler
-	sessionID string
-	mailID    string
-	logger    CustomLogger
+	version         uint32
+	actions         OptAction
+	protocol        OptProtocol
+	maxDataSize     int
+	fallback        bool
+	sock            io.ReadWriteCloser
+	headers         textproto.MIMEHeader
+	macros          map[Stage]map[string]string
+	merged          map[string]string           // cache of mergedMacros, nil after macros changed
+	stages          map[Stage]map[string]string // cache of stageMacros, nil after macros changed
+	symlists        RequestMacros
+	milter          SessionHandler
+	handler         ContextSessionHandler // milter with context, see resolveHandler
+	optional        interface{}           // implementation of optional handler interfaces
+	baseCtx         context.Context
+	connCtx         context.Context
+	connCancel      context.CancelFunc
+	msgCtx          context.Context
+	msgCancel       context.CancelFunc
+	sessionID       string
+	mailID          string
+	logger          CustomLogger
+	skipBody        bool
+	maxPacketSize   uint32
+	dropped         Response // RespConnFail or RespShutdown sent for the current SMTP connection
+	cmd             uint64   // sequence number << 8 | code of the command being processed, accessed atomically
+	seq             uint64
+	progress        time.Duration
+	wmu             sync.Mutex // serialises writes to sock
+	idleTimeout     time.Duration
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	errorHooks      []func(error)
+	handlerTimeouts map[byte]handlerTimeout
+	panicHandlers   []func(error)
+	panicResponse   Response
+	errorPolicy     func(error) Response
+	pending         chan struct{}   // closed when a handler call abandoned after its timeout returns
+	pendingWait     time.Duration   // how long to wait for pending
+	quit            <-chan struct{} // closed when the server shuts down
+	stateMu         sync.Mutex      // guards idle and woken
+	idle            bool            // waiting for a command outside of a message
+	woken           bool            // Shutdown interrupted the read of the idle session
 }
 
 func init() {
@@ -40,18 +77,143 @@ func (c *milterSession) genRandomID(length int) string {
 	return string(b)
 }
 
+// deadline kinds for setDeadline
+const (
+	deadlineRead = iota
+	deadlineWrite
+)
+
+// deadliner is implemented by sockets supporting timeouts like net.Conn
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// setDeadline sets the read or write deadline of the socket to timeout from now, or removes it
+// if timeout is 0. Without any configured timeout the socket is left untouched.
+func (m *milterSession) setDeadline(timeout time.Duration, kind int) {
+	if m.idleTimeout == 0 && m.readTimeout == 0 && m.writeTimeout == 0 {
+		return
+	}
+	// keep the deadline set by wake
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	if kind == deadlineRead && m.woken {
+		return
+	}
+	d, ok := m.sock.(deadliner)
+	if !ok {
+		return
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if kind == deadlineWrite {
+		d.SetWriteDeadline(deadline)
+	} else {
+		d.SetReadDeadline(deadline)
+	}
+}
+
+// timeoutError wraps socket timeouts into ErrTimeout
+func timeoutError(err error, what string) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %s: %v", ErrTimeout, what, err)
+	}
+	return err
+}
+
+// reportError passes errors ending a session to the error hooks
+func (m *milterSession) reportError(err error) {
+	for _, hook := range m.errorHooks {
+		hook(err)
+	}
+}
+
+// stage returns the code of the command currently processed or 0 between commands
+func (m *milterSession) stage() byte {
+	return byte(atomic.LoadUint64(&m.cmd))
+}
+
+// closing reports whether the server is shutting down
+func (m *milterSession) closing() bool {
+	select {
+	case <-m.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// setIdle marks the session as waiting for a command outside of a message
+func (m *milterSession) setIdle() {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.idle = true
+}
+
+// busy marks the session as receiving a command. It reports whether wake interrupted
+// the read before and removes the deadline wake set, so a command that arrived
+// at the same time is still processed.
+func (m *milterSession) busy() bool {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	woken := m.woken
+	m.idle, m.woken = false, false
+	if d, ok := m.sock.(deadliner); ok && woken {
+		d.SetReadDeadline(time.Time{})
+	}
+	return woken
+}
+
+// wake interrupts the read of an idle session on shutdown with a read deadline,
+// sessions receiving or processing a command are left alone
+func (m *milterSession) wake() {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	d, ok := m.sock.(deadliner)
+	if !ok || !m.idle || m.woken {
+		return
+	}
+	m.woken = true
+	d.SetReadDeadline(time.Now())
+}
+
+// token identifies the command currently processed, see writePacketAt
+func (m *milterSession) token() uint64 {
+	return atomic.LoadUint64(&m.cmd)
+}
+
 // ReadPacket reads incoming milter packet
 func (c *milterSession) ReadPacket() (*Message, error) {
-	// read packet length
+	// read packet length, waiting at most the idle timeout for the next command
+	c.setDeadline(c.idleTimeout, deadlineRead)
 	var length uint32
 	if err := binary.Read(c.sock, binary.BigEndian, &length); err != nil {
-		return nil, err
+		return nil, timeoutError(err, "idle timeout waiting for command")
+	}
+	// a command is arriving, shutdown must not interrupt it anymore
+	c.busy()
+
+	// refuse packets the MTA can not send legitimately before allocating them
+	if length == 0 {
+		return nil, fmt.Errorf("%w: empty packet", ErrMalformedPacket)
+	}
+	maxSize := c.maxPacketSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxPacketSize
+	}
+	if length > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrPacketTooLarge, length, maxSize)
 	}
 
 	// read packet data
+	c.setDeadline(c.readTimeout, deadlineRead)
 	data := make([]byte, length)
 	if _, err := io.ReadFull(c.sock, data); err != nil {
-		return nil, err
+		return nil, timeoutError(err, "read timeout")
 	}
 
 	// prepare response data
@@ -65,6 +227,52 @@ func (c *milterSession) ReadPacket() (*Message, error) {
 
 // WritePacket sends a milter response packet to socket stream
 func (m *milterSession) WritePacket(msg *Message) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.writePacket(msg)
+}
+
+// writePacketAt sends msg only while the command identified by token is processed and has
+// the code stage, so packets of handlers can never follow the reply to their command
+func (m *milterSession) writePacketAt(token uint64, stage byte, msg *Message) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if m.token() != token || m.stage() != stage {
+		return fmt.Errorf("%w: %c", ErrWrongStage, msg.Code)
+	}
+	return m.writePacket(msg)
+}
+
+// endCommand marks the current command as processed, packets of its handlers are rejected afterwards
+func (m *milterSession) endCommand() {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	atomic.StoreUint64(&m.cmd, 0)
+}
+
+// keepalive sends progress packets in the given interval until stop is called
+func (m *milterSession) keepalive(token uint64, stage byte, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := m.writePacketAt(token, stage, respProgress.Response()); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// writePacket writes a packet to the socket, callers hold wmu
+func (m *milterSession) writePacket(msg *Message) error {
+	m.setDeadline(m.writeTimeout, deadlineWrite)
 	buffer := bufio.NewWriter(m.sock)
 
 	// calculate and write response length
@@ -80,98 +288,134 @@ func (m *milterSession) WritePacket(msg *Message) error {
 
 	// write response data
 	if _, err := buffer.Write(msg.Data); err != nil {
-		return err
+		return timeoutError(err, "write timeout")
 	}
 
 	// flush data to network socket stream
 	if err := buffer.Flush(); err != nil {
-		return err
+		return timeoutError(err, "write timeout")
 	}
 
 	return nil
 }
 
-var ipv6prefix = []byte("IPv6:")
+// resetMessage clears the state of the current message
+func (m *milterSession) resetMessage() {
+	m.endMessage()
+	m.headers = nil
+	m.clearMacros(SMFIM_ENVFROM)
+	m.skipBody = false
+}
+
+// resetConnection clears the state of the current SMTP connection and starts a new session ID
+func (m *milterSession) resetConnection() {
+	m.resetMessage()
+	m.clearMacros(SMFIM_CONNECT)
+	m.dropped = nil
+	m.sessionID = m.genRandomID(12)
+	m.mailID = ""
+}
+
+// noReply maps commands to the protocol option telling the MTA not to wait for a reply
+var noReply = map[byte]OptProtocol{
+	SMFIC_CONNECT: OptNrConn,
+	SMFIC_HELO:    OptNrHelo,
+	SMFIC_MAIL:    OptNrMailFrom,
+	SMFIC_RCPT:    OptNrRcptTo,
+	SMFIC_DATA:    OptNrData,
+	SMFIC_UNKNOWN: OptNrUnknown,
+	SMFIC_HEADER:  OptNrHdr,
+	SMFIC_EOH:     OptNrEOH,
+	SMFIC_BODY:    OptNrBody,
+}
 
 // Process processes incoming milter commands
 func (m *milterSession) Process(msg *Message) (Response, error) {
+	if m.handler == nil {
+		m.handler, m.optional = resolveHandler(m.milter)
+	}
+
+	// after a connection failure or shutdown the SMTP connection is gone,
+	// handlers are not called anymore until a new connection starts
+	if m.dropped != nil {
+		switch msg.Code {
+		case SMFIC_ABORT, SMFIC_MACRO, SMFIC_OPTNEG, SMFIC_QUIT, SMFIC_QUIT_NC:
+		default:
+			return m.dropped, nil
+		}
+	}
+
+	// handler callback of the command, run by invoke
+	var call handlerCall
+	var mod *Modifier
+
 	switch msg.Code {
 	case SMFIC_ABORT:
 		// abort current message and start over
-		m.headers = nil
-		m.macros = nil
+		m.resetMessage()
 		// do not send response
 
 		// on SMFIC_ABORT
 		// Reset state to before SMFIC_MAIL and continue,
 		// unless connection is dropped by MTA
-		m.milter.Init(m.sessionID, m.mailID)
+		if err := m.callInit(); err != nil {
+			return nil, err
+		}
 
 		return nil, nil
 
 	case SMFIC_BODY:
-		// body chunk
-		return m.milter.BodyChunk(msg.Data, newModifier(m))
+		// body chunk, chunks still in flight after a skip are not passed to the handler
+		if m.skipBody {
+			return RespContinue, nil
+		}
+		mod = newModifier(m)
+		call = func(ctx context.Context) (Response, error) {
+			return m.handler.BodyChunk(ctx, msg.Data, mod)
+		}
 
 	case SMFIC_CONNECT:
-		// new connection, get hostname
-		Hostname := readCString(msg.Data)
-		msg.Data = msg.Data[len(Hostname)+1:]
-		// get protocol family
-		protocolFamily := msg.Data[0]
-		msg.Data = msg.Data[1:]
-		// get port
-		var Port uint16
-		if protocolFamily == SMFIA_INET || protocolFamily == SMFIA_INET6 {
-			if len(msg.Data) < 2 {
-				return RespTempFail, nil
-			}
-			Port = binary.BigEndian.Uint16(msg.Data)
-			msg.Data = msg.Data[2:]
-			// trim IPv6 prefix when necessary
-			if bytes.HasPrefix(msg.Data, ipv6prefix) {
-				msg.Data = bytes.TrimPrefix(msg.Data, ipv6prefix)
-			}
-		}
-		// get address
-		Address := readCString(msg.Data)
-		// convert address and port to human readable string
-		family := map[byte]string{
-			SMFIA_UNKNOWN: "unknown",
-			SMFIA_UNIX:    "unix",
-			SMFIA_INET:    "tcp4",
-			SMFIA_INET6:   "tcp6",
+		// new connection, get hostname, protocol family, port and address
+		info, err := decodeConnect(msg.Data)
+		if err != nil {
+			return nil, err
 		}
 		// run handler and return
-		return m.milter.Connect(
-			Hostname,
-			family[protocolFamily],
-			Port,
-			net.ParseIP(Address),
-			newModifier(m))
+		mod = newModifier(m)
+		call = func(ctx context.Context) (Response, error) {
+			return m.handler.Connect(ctx, info.host, info.family, info.port, info.addr, mod)
+		}
 
 	case SMFIC_MACRO:
 		// define macros
-		m.macros = make(map[string]string)
-		// convert data to Go strings
-		data := decodeCStrings(msg.Data[1:])
-		if len(data) != 0 {
-			// store data in a map
-			for i := 0; i < len(data); i += 2 {
-				m.macros[data[i]] = data[i+1]
-			}
+		code, macros, err := decodeMacro(msg.Data)
+		if err != nil {
+			return nil, err
 		}
+		stage, ok := macroStages[code]
+		if !ok {
+			m.logger.Printf("Ignoring macros for command code: %c", code)
+			return nil, nil
+		}
+		m.setMacros(stage, macros)
 		// do not send response
 		return nil, nil
 
 	case SMFIC_BODYEOB:
 		// End of body marker
-		return m.milter.Body(newModifier(m))
+		m.skipBody = false
+		mod = newModifier(m)
+		call = func(ctx context.Context) (Response, error) {
+			return m.handler.Body(ctx, mod)
+		}
 
 	case SMFIC_HELO:
 		// helo command HELO/EHLO name
 		name := strings.TrimSuffix(string(msg.Data), null)
-		return m.milter.Helo(name, newModifier(m))
+		mod = newModifier(m)
+		call = func(ctx context.Context) (Response, error) {
+			return m.handler.Helo(ctx, name, mod)
+		}
 
 	case SMFIC_HEADER:
 		// make sure headers is initialized - Mail header
@@ -179,77 +423,109 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 			m.headers = make(textproto.MIMEHeader)
 		}
 		// add new header to headers map
-		HeaderData := decodeCStrings(msg.Data)
-		// Handle headers with values (len=2) and empty header values (len=1)
-		if len(HeaderData) >= 1 {
-			name := HeaderData[0]
-			value := ""
-			if len(HeaderData) >= 2 {
-				value = HeaderData[1]
-			}
-			m.headers.Add(name, value)
-			// call and return milter handler
-			return m.milter.Header(name, value, newModifier(m))
+		name, value, err := decodeHeader(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		m.headers.Add(name, value)
+		// call and return milter handler
+		mod = newModifier(m)
+		call = func(ctx context.Context) (Response, error) {
+			return m.handler.Header(ctx, name, value, mod)
 		}
 
 	case SMFIC_MAIL:
 		// MAIL FROM: information
 		m.mailID = m.genRandomID(12)
+		m.startMessage()
 		// Call Init for a new Mail
-		m.milter.Init(m.sessionID, m.mailID)
-		// envelope from address
-		envfrom := readCString(msg.Data)
-		return m.milter.MailFrom(strings.Trim(envfrom, "<>"), newModifier(m))
-
-	case SMFIC_EOH:
-		// end of headers
-		return m.milter.Headers(m.headers, newModifier(m))
-
-	case SMFIC_OPTNEG:
-		// Option negotiation - ignore request and prepare response buffer
-		buffer := new(bytes.Buffer)
-		// prepare response data
-		for _, value := range []uint32{2, uint32(m.actions), uint32(m.protocol)} {
-			if err := binary.Write(buffer, binary.BigEndian, value); err != nil {
-				return nil, err
+		if err := m.callInit(); err != nil {
+			return nil, err
+		}
+		// envelope from address and ESMTP parameters
+		envfrom, args := parseEnvelope(msg.Data)
+		mod = newModifier(m)
+		call = func(ctx context.Context) (Response, error) {
+			if h, ok := m.optional.(MailFromArgsHandler); ok {
+				return h.MailFromArgs(envfrom, args, mod)
 			}
+			return m.handler.MailFrom(ctx, envfrom, mod)
 		}
 
-		// addsymlist to buffer
-		if m.symlists != nil {
-			for stage, macros := range m.symlists {
-				if err := binary.Write(buffer, binary.BigEndian, uint32(stage)); err != nil {
-					return nil, err
-				}
-				var macrosStrSlice []string
-				for _, macro := range macros {
-					macrosStrSlice = append(macrosStrSlice, string(macro))
-				}
-				macrosStr := strings.Join(macrosStrSlice, " ")
-				// add header name and value to buffer
-				data := []byte(macrosStr + null)
-				if _, err := buffer.Write(data); err != nil {
-					return nil, err
-				}
-			}
+	case SMFIC_EOH:
+		// end of headers
+		mod = newModifier(m)
+		call = func(ctx context.Context) (Response, error) {
+			return m.handler.Headers(ctx, mod.Headers, mod)
 		}
 
-		// build and send packet
-		return NewResponse(SMFIC_OPTNEG, buffer.Bytes()), nil
+	case SMFIC_OPTNEG:
+		// Option negotiation
+		return m.negotiate(msg.Data)
 
 	case SMFIC_QUIT:
 		// Quit milter communication
 		// client requested session close
 		return nil, ErrCloseSession
 
+	case SMFIC_QUIT_NC:
+		// Quit the SMTP connection, the MTA reuses this socket for the next one
+		if err := m.callDisconnect(); err != nil {
+			return nil, err
+		}
+		m.resetConnection()
+		m.startConnection()
+		if err := m.callInit(); err != nil {
+			return nil, err
+		}
+		// do not send response
+		return nil, nil
+
 	case SMFIC_RCPT:
 		// RCPT TO: information
-		// envelope to address
-		envto := readCString(msg.Data)
-		return m.milter.RcptTo(strings.Trim(envto, "<>"), newModifier(m))
+		// envelope to address and ESMTP parameters
+		envto, args := parseEnvelope(msg.Data)
+		mod = newModifier(m)
+		var rcpt RejectedRecipient
+		rejected := false
+		if m.protocol&OptRcptRej != 0 {
+			rcpt, rejected = rejectedRecipient(envto, args, m.macros[SMFIM_ENVRCPT])
+		}
+		if rejected {
+			h, ok := m.optional.(RejectedRcptHandler)
+			if !ok {
+				return RespContinue, nil
+			}
+			call = func(ctx context.Context) (Response, error) {
+				return h.RejectedRcpt(rcpt, mod)
+			}
+		} else {
+			call = func(ctx context.Context) (Response, error) {
+				if h, ok := m.optional.(RcptToArgsHandler); ok {
+					return h.RcptToArgs(envto, args, mod)
+				}
+				return m.handler.RcptTo(ctx, envto, mod)
+			}
+		}
 
 	case SMFIC_DATA:
-		// data, ignore
+		// DATA command, only handled by a DataHandler
+		if h, ok := m.optional.(DataHandler); ok {
+			mod = newModifier(m)
+			call = func(ctx context.Context) (Response, error) {
+				return h.Data(mod)
+			}
+		}
+
+	case SMFIC_UNKNOWN:
+		// unknown SMTP command, only handled by an UnknownHandler
+		if h, ok := m.optional.(UnknownHandler); ok {
+			cmd := readCString(msg.Data)
+			mod = newModifier(m)
+			call = func(ctx context.Context) (Response, error) {
+				return h.Unknown(cmd, mod)
+			}
+		}
 
 	default:
 		// print error and close session
@@ -257,6 +533,10 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 		return nil, ErrCloseSession
 	}
 
+	if call != nil {
+		return m.invoke(msg.Code, mod, call)
+	}
+
 	// by default continue with next milter message
 	return RespContinue, nil
 }
@@ -264,25 +544,64 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 // HandleMilterComands processes all milter commands in the same connection
 func (m *milterSession) HandleMilterCommands() {
 	defer m.sock.Close()
-	defer m.milter.Disconnect()
 
+	m.handler, m.optional = resolveHandler(m.milter)
 	m.sessionID = m.genRandomID(12)
+	m.startConnection()
+	defer m.endConnection()
+	defer func() {
+		if err := m.callDisconnect(); err != nil {
+			m.sessionError("Disconnect", err)
+		}
+	}()
 
-	// Call Init() for a new Session first
-	m.milter.Init(m.sessionID, m.mailID)
+	// Call Init() for a new Session first, the session can not go on after a panic
+	if err := m.callInit(); err != nil {
+		m.sessionError("Init", err)
+		return
+	}
 
+	// a message ends with its end of body command or when the MTA aborts it,
+	// macros sent ahead of a command do not count
+	var last byte
 	for {
+		// on shutdown the session ends once no message is in progress,
+		// Shutdown wakes sessions already waiting idle, see wake
+		if m.msgCtx == nil || last == SMFIC_BODYEOB {
+			m.setIdle()
+			if m.closing() {
+				return
+			}
+		}
+
 		// ReadPacket
 		msg, err := m.ReadPacket()
+		woken := m.busy()
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !(woken && m.closing()) {
 				m.logger.Printf("Error reading milter command: %v", err)
+				m.reportError(err)
 			}
 			return
 		}
+		if msg.Code != SMFIC_MACRO {
+			last = msg.Code
+		}
 
 		// process command
-		resp, err := m.Process(msg)
+		m.seq++
+		atomic.StoreUint64(&m.cmd, m.seq<<8|uint64(msg.Code))
+		stop := func() {}
+		if msg.Code == SMFIC_BODYEOB && m.progress > 0 {
+			stop = m.keepalive(m.token(), msg.Code, m.progress)
+		}
+		resp, err := m.process(msg)
+		stop()
+		m.endCommand()
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			resp, err = m.recovered(msg.Code, panicErr)
+		}
 		if err != nil {
 			if err != ErrCloseSession {
 				// log error condition
@@ -291,11 +610,33 @@ func (m *milterSession) HandleMilterCommands() {
 			return
 		}
 
+		// skip is only understood as answer to a body chunk and only if negotiated
+		if resp != nil && resp.Response().Code == SMFIR_SKIP {
+			if msg.Code != SMFIC_BODY || m.protocol&OptSkip == 0 {
+				m.logger.Printf("Ignoring skip response to command %c, OptSkip not negotiated or not a body chunk", msg.Code)
+				resp = RespContinue
+			} else {
+				m.skipBody = true
+			}
+		}
+
+		// the MTA does not expect a reply for stages negotiated with SMFIP_NR_*
+		if resp != nil && m.protocol&noReply[msg.Code] != 0 {
+			if code := resp.Response().Code; code != SMFIR_CONTINUE {
+				m.logger.Printf("Ignoring response %c to command %c, no reply was negotiated", code, msg.Code)
+			}
+			resp = nil
+		}
+
 		// ignore empty responses
 		if resp != nil {
+			if code := resp.Response().Code; code == SMFIR_SHUTDOWN || code == SMFIR_CONN_FAIL {
+				m.dropped = resp
+			}
 			// send back response message
 			if err = m.WritePacket(resp.Response()); err != nil {
 				m.logger.Printf("Error writing packet: %v", err)
+				m.reportError(err)
 				return
 			}
 		}
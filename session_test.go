@@ -0,0 +1,683 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/textproto"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bufferSock is an in-memory milter socket
+type bufferSock struct {
+	bytes.Buffer
+}
+
+func (b *bufferSock) Close() error { return nil }
+
+// optneg builds the payload of a SMFIC_OPTNEG packet as sent by the MTA
+func optneg(version uint32, actions OptAction, protocol OptProtocol) []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:4], version)
+	binary.BigEndian.PutUint32(data[4:8], uint32(actions))
+	binary.BigEndian.PutUint32(data[8:12], uint32(protocol))
+	return data
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name        string
+		fallback    bool
+		actions     OptAction
+		protocol    OptProtocol
+		symlists    RequestMacros
+		mta         []byte
+		fail        bool
+		err         error
+		version     uint32
+		wantActions OptAction
+		wantProto   OptProtocol
+	}{
+		{
+			name:        "full offer",
+			actions:     OptAddHeader | OptChangeFrom,
+			protocol:    OptNoHelo | OptNrHdr,
+			mta:         optneg(6, OptAllActions, 0x1fffff),
+			version:     6,
+			wantActions: OptAddHeader | OptChangeFrom,
+			wantProto:   OptNoHelo | OptNrHdr,
+		},
+		{
+			name:        "newer MTA",
+			actions:     OptAddHeader,
+			mta:         optneg(7, OptAllActions, 0x1fffff),
+			version:     SMFI_PROT_VERSION,
+			wantActions: OptAddHeader,
+		},
+		{
+			name:        "old MTA without symlist",
+			actions:     OptAddHeader,
+			symlists:    RequestMacros{SMFIM_CONNECT: {MACRO_DAEMON_NAME}},
+			mta:         optneg(2, OptAddHeader|OptChangeBody|OptAddRcpt|OptRemoveRcpt, 0x7f),
+			version:     2,
+			wantActions: OptAddHeader,
+		},
+		{
+			name:        "symlist adds action",
+			actions:     OptAddHeader,
+			symlists:    RequestMacros{SMFIM_CONNECT: {MACRO_DAEMON_NAME}},
+			mta:         optneg(6, OptAllActions, 0x1fffff),
+			version:     6,
+			wantActions: OptAddHeader | OptSetSymList,
+		},
+		{
+			name:        "all actions with symlist against MTA without symlist",
+			actions:     OptAllActions,
+			symlists:    RequestMacros{SMFIM_CONNECT: {MACRO_DAEMON_NAME}},
+			mta:         optneg(6, OptAllActions&^OptSetSymList, 0x1fffff),
+			version:     6,
+			wantActions: OptAllActions &^ OptSetSymList,
+		},
+		{
+			name: "version too old",
+			mta:  optneg(1, OptAllActions, 0x7f),
+			err:  ErrUnsupportedVersion,
+		},
+		{
+			name:    "missing action",
+			actions: OptAddHeader | OptChangeFrom,
+			mta:     optneg(6, OptAddHeader, 0x1fffff),
+			err:     ErrUnsupportedActions,
+		},
+		{
+			name:     "missing protocol option",
+			protocol: OptNrHdr,
+			mta:      optneg(2, OptAllActions, 0x7f),
+			err:      ErrUnsupportedProtocol,
+		},
+		{
+			name:        "fallback",
+			fallback:    true,
+			actions:     OptAddHeader | OptChangeFrom,
+			protocol:    OptNoHelo | OptNrHdr,
+			mta:         optneg(2, OptAddHeader, 0x7f),
+			version:     2,
+			wantActions: OptAddHeader,
+			wantProto:   OptNoHelo,
+		},
+		{
+			name:        "max data size is optional",
+			protocol:    OptMDS1M,
+			mta:         optneg(6, OptAllActions, 0x1fffff),
+			version:     6,
+			wantActions: OptNone,
+		},
+		{
+			name: "short packet",
+			mta:  []byte{0, 0, 0, 6},
+			fail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &milterSession{
+				actions:  tt.actions,
+				protocol: tt.protocol,
+				fallback: tt.fallback,
+				symlists: tt.symlists,
+				logger:   NopLogger,
+			}
+			resp, err := m.negotiate(tt.mta)
+			if tt.fail || tt.err != nil {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("expected error %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			msg := resp.Response()
+			if msg.Code != SMFIC_OPTNEG || len(msg.Data) < 12 {
+				t.Fatalf("unexpected reply %c %v", msg.Code, msg.Data)
+			}
+			if v := binary.BigEndian.Uint32(msg.Data[0:4]); v != tt.version {
+				t.Errorf("version: expected %d, got %d", tt.version, v)
+			}
+			if a := OptAction(binary.BigEndian.Uint32(msg.Data[4:8])); a != tt.wantActions {
+				t.Errorf("actions: expected 0x%x, got 0x%x", tt.wantActions, a)
+			}
+			if p := OptProtocol(binary.BigEndian.Uint32(msg.Data[8:12])); p != tt.wantProto {
+				t.Errorf("protocol: expected 0x%x, got 0x%x", tt.wantProto, p)
+			}
+			if m.actions != tt.wantActions || m.protocol != tt.wantProto || m.version != tt.version {
+				t.Errorf("session does not keep negotiated values")
+			}
+		})
+	}
+}
+
+func TestModifierAccessors(t *testing.T) {
+	m := &milterSession{actions: OptAddHeader | OptChangeFrom, protocol: OptNoHelo | OptMDS256K, logger: NopLogger}
+	if _, err := m.negotiate(optneg(6, OptAddHeader, 0x1fffff|OptMDS256K)); err == nil {
+		t.Fatal("expected negotiation error")
+	}
+	m.fallback = true
+	if _, err := m.negotiate(optneg(6, OptAddHeader, 0x1fffff|OptMDS256K)); err != nil {
+		t.Fatal(err)
+	}
+	mod := newModifier(m)
+	if mod.Actions() != OptAddHeader || !mod.HasAction(OptAddHeader) || mod.HasAction(OptAddHeader|OptChangeFrom) {
+		t.Errorf("unexpected actions 0x%x", mod.Actions())
+	}
+	if mod.Protocol() != OptNoHelo|OptMDS256K || mod.ProtocolVersion() != 6 || mod.MaxDataSize() != MaxDataSize256K {
+		t.Errorf("unexpected protocol 0x%x, version %d, data size %d", mod.Protocol(), mod.ProtocolVersion(), mod.MaxDataSize())
+	}
+
+	// a Modifier without session has nothing negotiated
+	empty := &Modifier{}
+	if empty.Actions() != OptNone || empty.HasAction(OptAddHeader) || empty.Protocol() != 0 ||
+		empty.ProtocolVersion() != 0 || empty.MaxDataSize() != 0 {
+		t.Error("expected zero values without session")
+	}
+	if err := empty.AddHeader("X-Test", "1"); !errors.Is(err, ErrActionNotNegotiated) {
+		t.Errorf("expected ErrActionNotNegotiated, got %v", err)
+	}
+	if err := empty.Progress(); !errors.Is(err, ErrWrongStage) {
+		t.Errorf("expected ErrWrongStage, got %v", err)
+	}
+}
+
+func TestModifierChecks(t *testing.T) {
+	sock := new(bufferSock)
+	m := &milterSession{actions: OptAddHeader, sock: sock, logger: NopLogger}
+
+	m.cmd = SMFIC_HEADER
+	mod := newModifier(m)
+	if err := mod.AddHeader("X-Test", "1"); !errors.Is(err, ErrWrongStage) {
+		t.Errorf("expected ErrWrongStage, got %v", err)
+	}
+	m.cmd = SMFIC_BODYEOB
+	mod = newModifier(m)
+	if err := mod.ChangeFrom("from@example.com"); !errors.Is(err, ErrActionNotNegotiated) {
+		t.Errorf("expected ErrActionNotNegotiated, got %v", err)
+	}
+	if sock.Len() != 0 {
+		t.Fatalf("rejected actions must not write to the socket")
+	}
+	if err := mod.AddHeader("X-Test", "1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if sock.Len() == 0 {
+		t.Errorf("AddHeader did not write a packet")
+	}
+
+	m.actions = OptAddRcptPartial | OptChangeFrom
+	mta := &milterSession{sock: sock}
+	for _, tt := range []struct {
+		do   func() error
+		code byte
+		data string
+	}{
+		{func() error { return mod.AddRecipientWithArgs("to@example.com", "NOTIFY=NEVER") }, SMFIR_ADDRCPT_PAR, "<to@example.com>\x00NOTIFY=NEVER\x00"},
+		{func() error { return mod.ChangeFromWithArgs("from@example.com", "RET=HDRS") }, SMFIR_CHGFROM, "from@example.com\x00RET=HDRS\x00"},
+		{func() error { return mod.ChangeFrom("from@example.com") }, SMFIR_CHGFROM, "from@example.com\x00"},
+	} {
+		sock.Reset()
+		if err := tt.do(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		msg, err := mta.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Code != tt.code || string(msg.Data) != tt.data {
+			t.Errorf("expected %c %q, got %c %q", tt.code, tt.data, msg.Code, msg.Data)
+		}
+	}
+}
+
+// testHandler answers every callback with resp
+type testHandler struct {
+	resp   Response
+	chunks int
+	delay  time.Duration
+}
+
+func (h *testHandler) Init(sessionID, mailID string) {}
+func (h *testHandler) Disconnect()                   {}
+func (h *testHandler) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	return h.resp, nil
+}
+func (h *testHandler) Helo(name string, m *Modifier) (Response, error)     { return h.resp, nil }
+func (h *testHandler) MailFrom(from string, m *Modifier) (Response, error) { return h.resp, nil }
+func (h *testHandler) RcptTo(rcptTo string, m *Modifier) (Response, error) { return h.resp, nil }
+func (h *testHandler) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	h.chunks++
+	return h.resp, nil
+}
+func (h *testHandler) Body(m *Modifier) (Response, error) {
+	time.Sleep(h.delay)
+	return h.resp, nil
+}
+func (h *testHandler) Header(name string, value string, m *Modifier) (Response, error) {
+	return h.resp, nil
+}
+func (h *testHandler) Headers(hdr textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return h.resp, nil
+}
+
+// testMTA is the MTA side of a milter session running over a pipe
+type testMTA struct {
+	t    *testing.T
+	conn net.Conn
+	mta  *milterSession
+	done chan struct{}
+}
+
+// startSession runs HandleMilterCommands for m and returns the MTA side of the connection
+func startSession(t *testing.T, m *milterSession) *testMTA {
+	client, server := net.Pipe()
+	m.sock = server
+	if m.logger == nil {
+		m.logger = NopLogger
+	}
+	mta := &testMTA{t: t, conn: client, mta: &milterSession{sock: client}, done: make(chan struct{})}
+	go func() {
+		defer close(mta.done)
+		m.HandleMilterCommands()
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-mta.done
+	})
+	return mta
+}
+
+func (c *testMTA) send(code byte, data []byte) {
+	c.t.Helper()
+	if err := c.mta.WritePacket(&Message{code, data}); err != nil {
+		c.t.Fatalf("send %c: %v", code, err)
+	}
+}
+
+func (c *testMTA) expect(code byte) *Message {
+	c.t.Helper()
+	msg, err := c.mta.ReadPacket()
+	if err != nil {
+		c.t.Fatalf("expected %c, got error %v", code, err)
+	}
+	if msg.Code != code {
+		c.t.Fatalf("expected %c, got %c", code, msg.Code)
+	}
+	return msg
+}
+
+func TestNoReply(t *testing.T) {
+	m := &milterSession{protocol: OptNrHelo, milter: &testHandler{resp: RespReject}}
+	mta := startSession(t, m)
+	mta.send(SMFIC_OPTNEG, optneg(6, OptAllActions, 0x1fffff))
+	mta.expect(SMFIC_OPTNEG)
+	// no reply for HELO, the next packet answers MAIL FROM
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	mta.send(SMFIC_MAIL, []byte("<from@example.com>"+null))
+	mta.expect(SMFIR_REJECT)
+}
+
+func TestSkip(t *testing.T) {
+	h := &testHandler{resp: RespSkip}
+	m := &milterSession{protocol: OptSkip, milter: h}
+	mta := startSession(t, m)
+	mta.send(SMFIC_OPTNEG, optneg(6, OptAllActions, 0x1fffff))
+	mta.expect(SMFIC_OPTNEG)
+	// skip is not valid outside of body chunks
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	mta.expect(SMFIR_CONTINUE)
+	mta.send(SMFIC_BODY, []byte("chunk 1"))
+	mta.expect(SMFIR_SKIP)
+	mta.send(SMFIC_BODY, []byte("chunk 2"))
+	mta.expect(SMFIR_CONTINUE)
+	mta.send(SMFIC_BODYEOB, nil)
+	mta.expect(SMFIR_CONTINUE)
+	if h.chunks != 1 {
+		t.Errorf("expected 1 body chunk after skip, got %d", h.chunks)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	m := &milterSession{milter: &testHandler{resp: RespAccept, delay: 50 * time.Millisecond}, progress: 10 * time.Millisecond}
+	mta := startSession(t, m)
+	mta.send(SMFIC_BODYEOB, nil)
+	mta.expect(SMFIR_PROGRESS)
+	for {
+		msg, err := mta.mta.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Code == SMFIR_ACCEPT {
+			break
+		}
+		if msg.Code != SMFIR_PROGRESS {
+			t.Fatalf("expected progress or accept, got %c", msg.Code)
+		}
+	}
+	if err := newModifier(m).Progress(); !errors.Is(err, ErrWrongStage) {
+		t.Errorf("expected ErrWrongStage after end of message, got %v", err)
+	}
+}
+
+// unknownHandler rejects unknown commands
+type unknownHandler struct {
+	testHandler
+	cmd string
+}
+
+func (h *unknownHandler) Unknown(cmd string, m *Modifier) (Response, error) {
+	h.cmd = cmd
+	return RespReject, nil
+}
+
+func TestUnknown(t *testing.T) {
+	mta := startSession(t, &milterSession{milter: &testHandler{resp: RespContinue}})
+	mta.send(SMFIC_DATA, nil)
+	mta.expect(SMFIR_CONTINUE)
+	mta.send(SMFIC_UNKNOWN, []byte("XFOO bar"+null))
+	mta.expect(SMFIR_CONTINUE)
+
+	h := &unknownHandler{testHandler: testHandler{resp: RespContinue}}
+	mta = startSession(t, &milterSession{milter: h})
+	mta.send(SMFIC_UNKNOWN, []byte("XFOO bar"+null))
+	mta.expect(SMFIR_REJECT)
+	if h.cmd != "XFOO bar" {
+		t.Errorf("expected unknown command XFOO bar, got %q", h.cmd)
+	}
+}
+
+// lifecycleHandler records Init and Disconnect calls
+type lifecycleHandler struct {
+	testHandler
+	calls []string
+}
+
+func (h *lifecycleHandler) Init(sessionID, mailID string) {
+	h.calls = append(h.calls, "init "+sessionID)
+}
+
+func (h *lifecycleHandler) Disconnect() {
+	h.calls = append(h.calls, "disconnect")
+}
+
+func TestQuitNewConnection(t *testing.T) {
+	h := &lifecycleHandler{testHandler: testHandler{resp: RespContinue}}
+	m := &milterSession{milter: h}
+	mta := startSession(t, m)
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	mta.expect(SMFIR_CONTINUE)
+	mta.send(SMFIC_QUIT_NC, nil)
+	// the socket stays open for the next connection
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	mta.expect(SMFIR_CONTINUE)
+	mta.send(SMFIC_QUIT, nil)
+	<-mta.done
+
+	if len(h.calls) != 4 || h.calls[1] != "disconnect" || h.calls[3] != "disconnect" {
+		t.Fatalf("unexpected lifecycle calls %v", h.calls)
+	}
+	if h.calls[0] == h.calls[2] {
+		t.Errorf("expected a new session ID after QUIT_NC, got %v", h.calls)
+	}
+}
+
+// countingHandler counts MailFrom calls
+type countingHandler struct {
+	testHandler
+	mails int
+}
+
+func (h *countingHandler) MailFrom(from string, m *Modifier) (Response, error) {
+	h.mails++
+	return h.resp, nil
+}
+
+func TestConnFail(t *testing.T) {
+	h := &countingHandler{testHandler: testHandler{resp: RespConnFail}}
+	mta := startSession(t, &milterSession{milter: h})
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	mta.expect(SMFIR_CONN_FAIL)
+	// the SMTP connection is gone, handlers are not called anymore
+	mta.send(SMFIC_MAIL, []byte("<from@example.com>"+null))
+	mta.expect(SMFIR_CONN_FAIL)
+	mta.send(SMFIC_ABORT, nil)
+	mta.send(SMFIC_QUIT_NC, nil)
+	h.resp = RespContinue
+	mta.send(SMFIC_MAIL, []byte("<from@example.com>"+null))
+	mta.expect(SMFIR_CONTINUE)
+	if h.mails != 1 {
+		t.Errorf("expected MailFrom only on the new connection, got %d calls", h.mails)
+	}
+}
+
+func TestReplaceBodyChunks(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 2*MaxDataSize64K+10)
+	for name, replace := range map[string]func(*Modifier) error{
+		"ReplaceBody":     func(mod *Modifier) error { return mod.ReplaceBody(body) },
+		"ReplaceBodyFrom": func(mod *Modifier) error { return mod.ReplaceBodyFrom(bytes.NewReader(body)) },
+	} {
+		sock := new(bufferSock)
+		m := &milterSession{actions: OptChangeBody, sock: sock, cmd: SMFIC_BODYEOB}
+		if err := replace(newModifier(m)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		mta := &milterSession{sock: sock}
+		var sizes []int
+		for sock.Len() > 0 {
+			msg, err := mta.ReadPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Code != SMFIR_REPLBODY {
+				t.Fatalf("%s: expected %c, got %c", name, SMFIR_REPLBODY, msg.Code)
+			}
+			sizes = append(sizes, len(msg.Data))
+		}
+		if len(sizes) != 3 || sizes[0] != MaxDataSize64K || sizes[1] != MaxDataSize64K || sizes[2] != 10 {
+			t.Errorf("%s: unexpected packet sizes %v", name, sizes)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	reported := make(chan error, 1)
+	m := &milterSession{
+		milter:      &testHandler{resp: RespContinue},
+		idleTimeout: 20 * time.Millisecond,
+		errorHooks:  []func(error){func(err error) { reported <- err }},
+	}
+	mta := startSession(t, m)
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	mta.expect(SMFIR_CONTINUE)
+	select {
+	case err := <-reported:
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("expected ErrTimeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle session was not closed")
+	}
+	<-mta.done
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	reported := make(chan error, 1)
+	m := &milterSession{
+		milter:          &testHandler{resp: RespReject, delay: 200 * time.Millisecond},
+		handlerTimeouts: map[byte]handlerTimeout{SMFIC_BODYEOB: {20 * time.Millisecond, RespContinue}},
+		errorHooks:      []func(error){func(err error) { reported <- err }},
+	}
+	mta := startSession(t, m)
+	// handlers without timeout answer as usual
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	mta.expect(SMFIR_REJECT)
+	// the slow end of message handler fails open
+	mta.send(SMFIC_BODYEOB, nil)
+	mta.expect(SMFIR_CONTINUE)
+	if err := <-reported; !errors.Is(err, ErrHandlerTimeout) {
+		t.Errorf("expected ErrHandlerTimeout, got %v", err)
+	}
+}
+
+// panicHandler panics in Helo
+type panicHandler struct {
+	testHandler
+}
+
+func (h *panicHandler) Helo(name string, m *Modifier) (Response, error) { panic("helo " + name) }
+
+func TestHandlerPanic(t *testing.T) {
+	reported := make(chan error, 1)
+	m := &milterSession{
+		milter:        &panicHandler{testHandler{resp: RespContinue}},
+		panicHandlers: []func(error){func(err error) { reported <- err }},
+	}
+	mta := startSession(t, m)
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	mta.expect(SMFIR_TEMPFAIL)
+	var p *PanicError
+	if err := <-reported; !errors.As(err, &p) || p.Value != "helo mx.example.com" || len(p.Stack) == 0 || p.SessionID == "" {
+		t.Errorf("unexpected panic report %#v", err)
+	}
+	// the session goes on with the next command
+	mta.send(SMFIC_MAIL, []byte("<a@example.com>"+null))
+	mta.expect(SMFIR_CONTINUE)
+
+	// without reply the session is closed
+	m = &milterSession{
+		protocol:      OptNrHelo,
+		milter:        &panicHandler{testHandler{resp: RespContinue}},
+		panicHandlers: []func(error){func(err error) {}},
+	}
+	mta = startSession(t, m)
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	<-mta.done
+}
+
+// slowHeaderHandler reads the headers of its Modifier longer than the handler timeout
+type slowHeaderHandler struct {
+	testHandler
+	running    int32
+	concurrent int32
+}
+
+func (h *slowHeaderHandler) Header(name string, value string, m *Modifier) (Response, error) {
+	if atomic.AddInt32(&h.running, 1) > 1 {
+		atomic.StoreInt32(&h.concurrent, 1)
+	}
+	defer atomic.AddInt32(&h.running, -1)
+	for end := time.Now().Add(40 * time.Millisecond); time.Now().Before(end); {
+		_ = m.Headers.Get("Subject")
+		time.Sleep(time.Millisecond)
+	}
+	return RespContinue, nil
+}
+
+func TestHandlerTimeoutNextCommand(t *testing.T) {
+	h := &slowHeaderHandler{}
+	m := &milterSession{
+		milter:          h,
+		handlerTimeouts: map[byte]handlerTimeout{0: {25 * time.Millisecond, RespTempFail}},
+	}
+	mta := startSession(t, m)
+	mta.send(SMFIC_HEADER, []byte("Subject"+null+"one"+null))
+	mta.expect(SMFIR_TEMPFAIL)
+	// the abandoned handler is still reading headers while the next one is added
+	mta.send(SMFIC_HEADER, []byte("Subject"+null+"two"+null))
+	mta.expect(SMFIR_TEMPFAIL)
+	mta.send(SMFIC_HEADER, []byte("Subject"+null+"three"+null))
+	mta.expect(SMFIR_TEMPFAIL)
+	mta.conn.Close()
+	<-mta.done
+	if atomic.LoadInt32(&h.concurrent) != 0 {
+		t.Error("handler was called concurrently")
+	}
+}
+
+// initPanicHandler panics in Init
+type initPanicHandler struct {
+	testHandler
+}
+
+func (h *initPanicHandler) Init(sessionID, mailID string) { panic("init") }
+
+// slowPanicHandler panics in Body after the handler timeout passed
+type slowPanicHandler struct {
+	testHandler
+}
+
+func (h *slowPanicHandler) Body(m *Modifier) (Response, error) {
+	time.Sleep(30 * time.Millisecond)
+	panic("late")
+}
+
+func TestInitPanic(t *testing.T) {
+	// without panic handlers the session still closes without crashing
+	mta := startSession(t, &milterSession{milter: &initPanicHandler{}})
+	<-mta.done
+
+	reported := make(chan error, 2)
+	mta = startSession(t, &milterSession{
+		milter:        &initPanicHandler{},
+		panicHandlers: []func(error){func(err error) { reported <- err }},
+	})
+	<-mta.done
+	var p *PanicError
+	if err := <-reported; !errors.As(err, &p) || p.Value != "init" {
+		t.Errorf("unexpected panic report %v", err)
+	}
+}
+
+func TestAbandonedHandlerPanic(t *testing.T) {
+	reported := make(chan error, 1)
+	m := &milterSession{
+		milter:          &slowPanicHandler{testHandler{resp: RespContinue}},
+		handlerTimeouts: map[byte]handlerTimeout{0: {10 * time.Millisecond, RespContinue}},
+		panicHandlers:   []func(error){func(err error) { reported <- err }},
+	}
+	mta := startSession(t, m)
+	mta.send(SMFIC_BODYEOB, nil)
+	mta.expect(SMFIR_CONTINUE)
+	select {
+	case err := <-reported:
+		var p *PanicError
+		if !errors.As(err, &p) || p.Value != "late" {
+			t.Errorf("unexpected panic report %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("panic of the abandoned handler was not reported")
+	}
+}
+
+func TestHandlerTimeoutHung(t *testing.T) {
+	h := &blockingHandler{testHandler{resp: RespContinue}, make(chan struct{})}
+	defer close(h.release)
+	m := &milterSession{
+		milter:          h,
+		handlerTimeouts: map[byte]handlerTimeout{SMFIC_BODYEOB: {20 * time.Millisecond, RespContinue}},
+	}
+	mta := startSession(t, m)
+	mta.send(SMFIC_BODYEOB, nil)
+	mta.expect(SMFIR_CONTINUE)
+	// the next message can not be handled while the handler hangs, the session ends
+	mta.send(SMFIC_MAIL, []byte("<a@example.com>"+null))
+	select {
+	case <-mta.done:
+	case <-time.After(time.Second):
+		t.Fatal("session with hung handler did not end")
+	}
+}
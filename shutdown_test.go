@@ -0,0 +1,180 @@
+package milter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer runs a Server with sessions of h and returns it with a connected MTA
+// and the channel receiving the result of Run
+func startServer(t *testing.T, h SessionHandler) (*Server, *milterSession, chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := func() (SessionHandler, OptAction, OptProtocol, RequestMacros) {
+		return h, 0, 0, nil
+	}
+	s := New(factory, WithListener(listener), WithLogger(NopLogger))
+	run := make(chan error, 1)
+	go func() { run <- s.Run() }()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return s, &milterSession{sock: conn}, run
+}
+
+// roundtrip sends a command and expects code as reply
+func roundtrip(t *testing.T, mta *milterSession, code byte, data string, reply byte) {
+	t.Helper()
+	if err := mta.WritePacket(&Message{code, []byte(data)}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mta.ReadPacket()
+	if err != nil || msg.Code != reply {
+		t.Fatalf("expected %c, got %v %v", reply, msg, err)
+	}
+}
+
+func TestShutdownUnstarted(t *testing.T) {
+	var s Server
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShutdownIdle(t *testing.T) {
+	s, mta, _ := startServer(t, &testHandler{resp: RespContinue})
+	roundtrip(t, mta, SMFIC_HELO, "mx.example.com"+null, SMFIR_CONTINUE)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown of idle session failed: %v", err)
+	}
+	if _, err := mta.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected closed connection, got %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShutdownMessage(t *testing.T) {
+	s, mta, _ := startServer(t, &testHandler{resp: RespContinue})
+	roundtrip(t, mta, SMFIC_MAIL, "<a@example.com>"+null, SMFIR_CONTINUE)
+
+	// the message in progress can finish
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		if err := mta.WritePacket(&Message{SMFIC_BODYEOB, nil}); err != nil {
+			t.Error(err)
+		}
+		if msg, err := mta.ReadPacket(); err != nil || msg.Code != SMFIR_CONTINUE {
+			t.Errorf("expected end of message reply, got %v %v", msg, err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("graceful shutdown failed: %v", err)
+	}
+
+	// a message that does not finish in time is cut off
+	slow, slowMTA, _ := startServer(t, &testHandler{resp: RespContinue})
+	roundtrip(t, slowMTA, SMFIC_MAIL, "<a@example.com>"+null, SMFIR_CONTINUE)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var shutdownErr *ShutdownError
+	if err := slow.Shutdown(ctx); !errors.As(err, &shutdownErr) || shutdownErr.Closed != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected ShutdownError for one connection, got %v", err)
+	}
+}
+
+// blockingHandler blocks in Body until release is closed
+type blockingHandler struct {
+	testHandler
+	release chan struct{}
+}
+
+func (h *blockingHandler) Body(m *Modifier) (Response, error) {
+	<-h.release
+	return RespContinue, nil
+}
+
+func TestShutdownBlockedHandler(t *testing.T) {
+	h := &blockingHandler{testHandler{resp: RespContinue}, make(chan struct{})}
+	defer close(h.release)
+	s, mta, run := startServer(t, h)
+	roundtrip(t, mta, SMFIC_MAIL, "<a@example.com>"+null, SMFIR_CONTINUE)
+	if err := mta.WritePacket(&Message{SMFIC_BODYEOB, nil}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var shutdownErr *ShutdownError
+	if err := s.Shutdown(ctx); !errors.As(err, &shutdownErr) || shutdownErr.Closed != 1 {
+		t.Fatalf("expected ShutdownError for one connection, got %v", err)
+	}
+	select {
+	case err := <-run:
+		if err != nil {
+			t.Errorf("unexpected Run error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the forced shutdown")
+	}
+}
+
+func TestWakeIdleSession(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	m := &milterSession{sock: server}
+	mta := &milterSession{sock: client}
+	send := func() {
+		go mta.WritePacket(&Message{SMFIC_MAIL, []byte("<a@example.com>" + null)})
+	}
+
+	// sessions receiving a command are not interrupted
+	m.wake()
+	send()
+	if _, err := m.ReadPacket(); err != nil {
+		t.Fatalf("busy session was interrupted: %v", err)
+	}
+
+	// a command arriving while Shutdown wakes the idle session is still read
+	m.setIdle()
+	m.wake()
+	if !m.busy() {
+		t.Error("expected woken session")
+	}
+	send()
+	if _, err := m.ReadPacket(); err != nil {
+		t.Fatalf("command after wake was not read: %v", err)
+	}
+
+	// an idle read is interrupted
+	m.setIdle()
+	m.wake()
+	if _, err := m.ReadPacket(); err == nil {
+		t.Fatal("expected interrupted read")
+	}
+	if !m.busy() {
+		t.Error("expected woken session")
+	}
+}
@@ -0,0 +1,67 @@
+package milter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// listenUnix binds the Unix socket path. A stale socket left by a previous run is removed,
+// a socket another process still listens on is not touched. The socket gets the mode and
+// owner set with WithUnixSocketMode and WithUnixSocketOwner and is removed when the server closes.
+func (s *Server) listenUnix(ctx context.Context, path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	var config net.ListenConfig
+	listener, err := config.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("milter: %w", err)
+	}
+	if unix, ok := listener.(*net.UnixListener); ok {
+		unix.SetUnlinkOnClose(true)
+	}
+	if s.socketMode != 0 {
+		if err := os.Chmod(path, s.socketMode); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("milter: %w", err)
+		}
+	}
+	if s.socketOwner {
+		if err := os.Chown(path, s.socketUID, s.socketGID); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("milter: %w", err)
+		}
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket at path if nobody accepts connections on it
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("milter: %w", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%w: %s", ErrNotSocket, path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %s", ErrSocketInUse, path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("milter: check socket: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("milter: remove stale socket: %w", err)
+	}
+	return nil
+}
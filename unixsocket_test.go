@@ -0,0 +1,64 @@
+package milter
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "milter.sock")
+
+	// a socket nobody listens on is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	// the liveness probe of the second server opens a session on this one
+	factory := func() (SessionHandler, OptAction, OptProtocol, RequestMacros) {
+		return &testHandler{resp: RespContinue}, 0, 0, nil
+	}
+	s := New(factory, WithUnixSocket(path), WithUnixSocketMode(0o660), WithLogger(NopLogger))
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	var info os.FileInfo
+	for i := 0; i < 100; i++ {
+		if info, err = os.Stat(path); err == nil && info.Mode().Perm() == 0o660 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || info.Mode().Perm() != 0o660 {
+		t.Fatalf("expected socket with mode 0660, got %v %v", info, err)
+	}
+
+	// a live socket is not taken over
+	if err := New(nil, WithUnixSocket(path)).Run(); !errors.Is(err, ErrSocketInUse) {
+		t.Errorf("expected ErrSocketInUse, got %v", err)
+	}
+
+	// the socket is removed on Close
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected Run error %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket was not removed: %v", err)
+	}
+
+	// other files are never removed
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(nil, WithUnixSocket(path)).Run(); !errors.Is(err, ErrNotSocket) {
+		t.Errorf("expected ErrNotSocket, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package milter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VerdictError is a handler error that tells the session which response to send to the MTA,
+// instead of closing the milter connection
+type VerdictError struct {
+	Err      error
+	Response Response
+	invalid  error // why the reply passed to Reject was not used
+}
+
+func (e *VerdictError) Error() string {
+	if e.Err == nil {
+		return "milter verdict"
+	}
+	return e.Err.Error()
+}
+
+func (e *VerdictError) Unwrap() error {
+	return e.Err
+}
+
+// TempFail wraps err so the session answers the command with RespTempFail,
+// e.g. for a failed DNS lookup
+func TempFail(err error) error {
+	return &VerdictError{Err: err, Response: RespTempFail}
+}
+
+// Reject wraps err so the session rejects the command, reply is an optional
+// 5xx SMTP reply like "550 5.7.1 policy violation" that is validated like Reply does.
+// An invalid reply is logged and the command is rejected with RespReject.
+func Reject(err error, reply string) error {
+	if reply == "" {
+		return &VerdictError{Err: err, Response: RespReject}
+	}
+	resp, invalid := parseReply(reply)
+	if invalid != nil {
+		return &VerdictError{Err: err, Response: RespReject, invalid: invalid}
+	}
+	return &VerdictError{Err: err, Response: resp}
+}
+
+// parseReply splits reply into code, enhanced status code and text and builds it with Reply
+func parseReply(reply string) (*CustomResponse, error) {
+	code, text, _ := strings.Cut(reply, " ")
+	n, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 {
+		return nil, fmt.Errorf("%w: malformed reply code %q", ErrInvalidReply, code)
+	}
+	if n/100 != 5 {
+		return nil, fmt.Errorf("%w: reject needs a 5xx reply code, got %d", ErrInvalidReply, n)
+	}
+	enhanced := ""
+	if first, rest, _ := strings.Cut(text, " "); enhancedStatus.MatchString(first) {
+		enhanced, text = first, rest
+	}
+	return Reply(n, enhanced, text)
+}
+
+// verdict returns the response sent for a handler error, nil closes the session
+func (m *milterSession) verdict(err error) Response {
+	var v *VerdictError
+	if errors.As(err, &v) && v.Response != nil {
+		if v.invalid != nil {
+			m.logger.Printf("Rejecting with default reply: %v", v.invalid)
+		}
+		return v.Response
+	}
+	if m.errorPolicy != nil {
+		return m.errorPolicy(err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package milter
+
+import (
+	"errors"
+	"testing"
+)
+
+var errLookup = errors.New("lookup failed")
+
+// errHandler returns err from Helo and MailFrom
+type errHandler struct {
+	testHandler
+	err error
+}
+
+func (h *errHandler) Helo(name string, m *Modifier) (Response, error)     { return nil, h.err }
+func (h *errHandler) MailFrom(from string, m *Modifier) (Response, error) { return nil, h.err }
+
+func TestVerdictErrors(t *testing.T) {
+	h := &errHandler{testHandler: testHandler{resp: RespContinue}}
+	mta := startSession(t, &milterSession{milter: h})
+
+	h.err = TempFail(errLookup)
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	mta.expect(SMFIR_TEMPFAIL)
+
+	h.err = Reject(errLookup, "550 5.7.1 policy violation")
+	mta.send(SMFIC_MAIL, []byte("<a@example.com>"+null))
+	if msg := mta.expect(SMFIR_REPLYCODE); string(msg.Data) != "550 5.7.1 policy violation"+null {
+		t.Errorf("unexpected reply %q", msg.Data)
+	}
+
+	// replies are validated and escaped like Reply does
+	h.err = Reject(errLookup, "550 5.7.1 100% spam")
+	mta.send(SMFIC_MAIL, []byte("<a@example.com>"+null))
+	if msg := mta.expect(SMFIR_REPLYCODE); string(msg.Data) != "550 5.7.1 100%% spam"+null {
+		t.Errorf("unexpected reply %q", msg.Data)
+	}
+	for _, reply := range []string{"250 ok", "451 4.7.1 later", "55x nope", "550 5.7.1 a\x00b"} {
+		h.err = Reject(errLookup, reply)
+		var v *VerdictError
+		if !errors.As(h.err, &v) || !errors.Is(v.invalid, ErrInvalidReply) {
+			t.Errorf("Reject(%q): expected invalid reply", reply)
+		}
+		mta.send(SMFIC_MAIL, []byte("<a@example.com>"+null))
+		mta.expect(SMFIR_REJECT)
+	}
+
+	// plain errors close the session
+	h.err = errLookup
+	mta.send(SMFIC_MAIL, []byte("<a@example.com>"+null))
+	<-mta.done
+}
+
+func TestErrorPolicy(t *testing.T) {
+	h := &errHandler{testHandler: testHandler{resp: RespContinue}, err: errLookup}
+	policy := func(err error) Response {
+		if errors.Is(err, errLookup) {
+			return RespTempFail
+		}
+		return nil
+	}
+	mta := startSession(t, &milterSession{milter: h, errorPolicy: policy})
+	mta.send(SMFIC_HELO, []byte("mx.example.com"+null))
+	mta.expect(SMFIR_TEMPFAIL)
+	// verdicts of the handler win over the policy
+	h.err = Reject(errLookup, "")
+	mta.send(SMFIC_MAIL, []byte("<a@example.com>"+null))
+	mta.expect(SMFIR_REJECT)
+	// nil from the policy closes the session
+	h.err = errors.New("other")
+	mta.send(SMFIC_MAIL, []byte("<a@example.com>"+null))
+	<-mta.done
+}